@@ -0,0 +1,364 @@
+package moria
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Access log formats named by ACCESS_LOG_FORMAT.  Any other value is parsed
+// as a text/template over AccessEntry, e.g.
+//
+//	{{.Method}} {{.URI}} {{.Status}} {{.Upstream}} {{.Duration}}
+const (
+	CommonLogFormat   = "common"
+	CombinedLogFormat = "combined"
+	JSONLogFormat     = "json"
+)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessEntry describes a request once its response has been written.
+type AccessEntry struct {
+	Time            time.Time     // When the request was received.
+	RemoteAddr      string        // The client address, without the port.
+	User            string        // The authenticated caller, if any.
+	Method          string        // The request method.
+	URI             string        // The request URI with secrets masked.
+	Proto           string        // The protocol, e.g. "HTTP/2.0".
+	Status          int           // The status sent to the client.
+	Bytes           int64         // The number of body bytes sent to the client.
+	Referer         string        // The Referer header.
+	UserAgent       string        // The User-Agent header.
+	RequestID       string        // The X-Request-Id of the request.
+	Route           string        // The route that matched, e.g. "GET /orders/:id".
+	Service         string        // The service the route belongs to.
+	Upstream        string        // The backend address the request went to.
+	UpstreamLatency time.Duration // How long the backend took to answer.
+	Duration        time.Duration // How long the gateway took to respond.
+}
+
+// AccessLog writes an entry for every request once its response is written,
+// in Common or Combined Log Format, as JSON or through a template.  Common
+// and Combined entries are followed by the upstream address and the upstream
+// and total latencies in milliseconds, e.g.
+//
+//	... "curl/8.0" "10.0.3.7:8080" 12ms 14ms
+type AccessLog struct {
+	out      io.Writer
+	mu       sync.Mutex
+	format   func(*AccessEntry) ([]byte, error)
+	redactor *Redactor
+	log      Logger
+}
+
+// NewAccessLog returns an access log writing to w in format, one of
+// CommonLogFormat, CombinedLogFormat, JSONLogFormat or a template.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	l := &AccessLog{out: w, redactor: DefaultRedactor}
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", CombinedLogFormat:
+		l.format = func(e *AccessEntry) ([]byte, error) { return formatCLF(e, true), nil }
+	case CommonLogFormat:
+		l.format = func(e *AccessEntry) ([]byte, error) { return formatCLF(e, false), nil }
+	case JSONLogFormat:
+		l.format = formatAccessJSON
+	default:
+		tmpl, err := template.New("access").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %v", err)
+		}
+		l.format = func(e *AccessEntry) ([]byte, error) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, e); err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+				b.WriteByte('\n')
+			}
+			return b.Bytes(), nil
+		}
+	}
+	return l, nil
+}
+
+// AccessLogFromEnv reads ACCESS_LOG, the file to write to or "-" for stdout,
+// and ACCESS_LOG_FORMAT, combined by default.  Requests are not logged when
+// ACCESS_LOG is empty or "off".  URIs are masked as described by Redaction.
+// The file is returned so that it can be reopened on SIGHUP; it is nil when
+// the log does not go to a file.
+func AccessLogFromEnv() (*AccessLog, *LogFile, error) {
+	var w io.Writer = os.Stdout
+	var file *LogFile
+	switch path := os.Getenv("ACCESS_LOG"); path {
+	case "", "off":
+		return nil, nil, nil
+	case "-":
+	default:
+		var err error
+		if file, err = OpenLogFile(path); err != nil {
+			return nil, nil, err
+		}
+		w = file
+	}
+	l, err := NewAccessLog(w, os.Getenv("ACCESS_LOG_FORMAT"))
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, nil, err
+	}
+	l.redactor = Redaction()
+	return l, file, nil
+}
+
+// Handler logs the requests served by handler.  The mux fills in the route,
+// upstream and caller of the requests it forwards.
+func (l *AccessLog) Handler(handler http.Handler) http.Handler {
+	if l == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// Log the path and query even for absolute-form request lines.
+		uri := *request.URL
+		uri.Scheme, uri.Host, uri.User = "", "", nil
+		entry := &AccessEntry{
+			Time:       time.Now(),
+			RemoteAddr: request.RemoteAddr,
+			Method:     request.Method,
+			URI:        l.redactor.URL(&uri),
+			Proto:      request.Proto,
+			Referer:    request.Referer(),
+			UserAgent:  request.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			entry.RemoteAddr = host
+		}
+		aw := &statusWriter{ResponseWriter: writer}
+		handler.ServeHTTP(aw, withAccessEntry(request, entry))
+		entry.Duration = time.Since(entry.Time)
+		entry.Status, entry.Bytes = aw.status, aw.bytes
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if entry.RequestID == "" {
+			entry.RequestID = request.Header.Get(XRequestID)
+		}
+		l.write(entry)
+	})
+}
+
+func (l *AccessLog) write(entry *AccessEntry) {
+	line, err := l.format(entry)
+	if err != nil {
+		orDefault(l.log).Errorf("Unable to format access log entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		orDefault(l.log).Errorf("Unable to write access log: %v", err)
+	}
+}
+
+// formatCLF writes an entry in Common Log Format, or Combined Log Format
+// when combined is set, followed by the upstream fields.
+func formatCLF(e *AccessEntry, combined bool) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s - %s [%s] %q %d %s",
+		clfField(e.RemoteAddr), clfField(e.User), e.Time.Format(clfTime),
+		e.Method+" "+e.URI+" "+e.Proto, e.Status, clfBytes(e.Bytes))
+	if combined {
+		fmt.Fprintf(&b, " %q %q", e.Referer, e.UserAgent)
+	}
+	fmt.Fprintf(&b, " %q %dms %dms\n", clfField(e.Upstream), milliseconds(e.UpstreamLatency), milliseconds(e.Duration))
+	return b.Bytes()
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+func clfBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// formatAccessJSON writes an entry as one JSON object, with latencies in
+// seconds.
+func formatAccessJSON(e *AccessEntry) ([]byte, error) {
+	line, err := json.Marshal(struct {
+		Time            string  `json:"time"`
+		RemoteAddr      string  `json:"remote_addr"`
+		User            string  `json:"user,omitempty"`
+		Method          string  `json:"method"`
+		URI             string  `json:"uri"`
+		Proto           string  `json:"proto"`
+		Status          int     `json:"status"`
+		Bytes           int64   `json:"bytes"`
+		Referer         string  `json:"referer,omitempty"`
+		UserAgent       string  `json:"user_agent,omitempty"`
+		RequestID       string  `json:"request_id,omitempty"`
+		Route           string  `json:"route,omitempty"`
+		Service         string  `json:"service,omitempty"`
+		Upstream        string  `json:"upstream,omitempty"`
+		UpstreamLatency float64 `json:"upstream_latency"`
+		Duration        float64 `json:"duration"`
+	}{
+		e.Time.UTC().Format(time.RFC3339Nano), e.RemoteAddr, e.User, e.Method, e.URI, e.Proto,
+		e.Status, e.Bytes, e.Referer, e.UserAgent, e.RequestID, e.Route, e.Service,
+		e.Upstream, e.UpstreamLatency.Seconds(), e.Duration.Seconds(),
+	})
+	return append(line, '\n'), err
+}
+
+type accessEntryKey struct{}
+
+func withAccessEntry(request *http.Request, entry *AccessEntry) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), accessEntryKey{}, entry))
+}
+
+// accessEntry returns the access log entry of a request, or nil when the
+// request is not being logged.
+func accessEntry(request *http.Request) *AccessEntry {
+	entry, _ := request.Context().Value(accessEntryKey{}).(*AccessEntry)
+	return entry
+}
+
+// statusWriter records the status and body size of a response.  It passes
+// flushes through for streamed responses and lets upgraded connections be
+// hijacked.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 || w.status < 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogFile is a log file that can be reopened after it has been rotated.
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	log  Logger
+}
+
+// OpenLogFile opens path for appending, creating it if needed.
+func OpenLogFile(path string) (*LogFile, error) {
+	f := &LogFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reopen closes the file and opens path again, picking up a new file after
+// the old one was moved away by logrotate or the like.
+func (f *LogFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+// ReopenOnSIGHUP reopens the file whenever the process receives SIGHUP,
+// until stop is closed.
+func (f *LogFile) ReopenOnSIGHUP(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := f.Reopen(); err != nil {
+					orDefault(f.log).Errorf("Unable to reopen %v: %v", f.path, err)
+				} else {
+					orDefault(f.log).Infof("Reopened %v", f.path)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Close closes the file.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,139 @@
+package moria_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+// logRequest serves a GET for path through an access log in format and
+// returns what was logged.
+func logRequest(t *testing.T, format, path string) (string, string) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders/:id"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) }))
+	defer backend.Close()
+	defer gateway.Close()
+	var buf bytes.Buffer
+	accessLog, err := moria.NewAccessLog(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "http://gateway"+path, nil)
+	request.RemoteAddr = "203.0.113.9:5000"
+	request.Header.Set("Referer", "https://example.com/")
+	request.Header.Set("User-Agent", "curl/8.0")
+	accessLog.Handler(mux).ServeHTTP(httptest.NewRecorder(), request)
+	return buf.String(), strings.TrimPrefix(backend.URL, "http://")
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line, upstream := logRequest(t, moria.CombinedLogFormat, "/api/orders/1?api_key=secret")
+	for _, part := range []string{
+		"203.0.113.9 - - [",
+		`] "GET /api/orders/1?api_key=[REDACTED] HTTP/1.1" 200 5 "https://example.com/" "curl/8.0" "` + upstream + `" `,
+	} {
+		if !strings.Contains(line, part) {
+			t.Errorf("Expected %q in %q", part, line)
+		}
+	}
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "ms\n") {
+		t.Errorf("Expected one entry ending with the latencies got %q", line)
+	}
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	line, _ := logRequest(t, moria.CommonLogFormat, "/api/missing")
+	if !strings.Contains(line, `"GET /api/missing HTTP/1.1" 404 `) || strings.Contains(line, "curl/8.0") {
+		t.Errorf("Expected a common log entry for the 404 got %q", line)
+	}
+	if !strings.Contains(line, ` "-" `) {
+		t.Errorf("Expected no upstream for an unmatched request got %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	line, upstream := logRequest(t, moria.JSONLogFormat, "/api/orders/1")
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Expected a JSON entry got %q: %v", line, err)
+	}
+	expected := map[string]interface{}{
+		"remote_addr": "203.0.113.9", "uri": "/api/orders/1", "status": 200.0, "bytes": 5.0,
+		"route": "GET /orders/:id", "service": "test-service", "upstream": upstream,
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("Expected %v: %v got %v", k, v, entry[k])
+		}
+	}
+	if entry["request_id"] == nil || entry["upstream_latency"] == nil || entry["duration"] == nil {
+		t.Errorf("Expected the request ID and latencies got %v", entry)
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	line, upstream := logRequest(t, "{{.Method}} {{.Route}} {{.Status}} {{.Upstream}}", "/api/orders/1")
+	if expected := "GET GET /orders/:id 200 " + upstream + "\n"; line != expected {
+		t.Errorf("Expected %q got %q", expected, line)
+	}
+	if _, err := moria.NewAccessLog(ioutil.Discard, "{{.Method"); err == nil {
+		t.Error("Expected an invalid template to be refused")
+	}
+}
+
+func TestAccessLogFromEnv(t *testing.T) {
+	for _, value := range []string{"", "off"} {
+		t.Setenv("ACCESS_LOG", value)
+		if l, file, err := moria.AccessLogFromEnv(); l != nil || file != nil || err != nil {
+			t.Errorf("%q: expected no access log got %v %v %v", value, l, file, err)
+		}
+	}
+	t.Setenv("ACCESS_LOG", "-")
+	if l, file, err := moria.AccessLogFromEnv(); l == nil || file != nil || err != nil {
+		t.Errorf("Expected an access log on stdout got %v %v %v", l, file, err)
+	}
+	t.Setenv("ACCESS_LOG", filepath.Join(t.TempDir(), "access.log"))
+	l, file, err := moria.AccessLogFromEnv()
+	if l == nil || file == nil || err != nil {
+		t.Fatalf("Expected an access log file got %v %v %v", l, file, err)
+	}
+	file.Close()
+}
+
+func TestLogFileReopenOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := moria.OpenLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	f.ReopenOnSIGHUP(stop)
+
+	f.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	f.Write([]byte("after\n"))
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+	if string(rotated) != "before\n" || string(current) != "after\n" {
+		t.Errorf("Expected the file to be reopened got %q and %q", rotated, current)
+	}
+}
@@ -0,0 +1,163 @@
+package moria
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// XAPIKey is the header callers send their API key in.
+	XAPIKey = "X-Api-Key"
+	// XAPIKeyName tells backends which key a request was made with.
+	XAPIKeyName = "X-Api-Key-Name"
+	// apiKeyParam is the query parameter accepted in place of XAPIKey.
+	apiKeyParam = "api_key"
+)
+
+// APIKey is a partner key as stored in etcd under
+// /gateway/apikeys/<env>/<sha256 of the key in hex>, so the key itself is
+// never at rest, e.g.
+//
+//	{"name": "acme", "scopes": ["orders", "billing:POST /invoices"]}
+//
+// A scope is a service name, a service and one of its routes, or * for
+// every route that accepts API keys.  Deleting the etcd key revokes it.
+type APIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// allows reports whether the key may call route on service.
+func (k *APIKey) allows(service string, route *EtcdRoute) bool {
+	name := service + ":" + routeName(route)
+	for _, scope := range k.Scopes {
+		if scope == "*" || scope == service || scope == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the name an API key is stored under.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeys holds the API keys the gateway accepts, by hash.
+type APIKeys struct {
+	mu   sync.RWMutex
+	keys map[string]*APIKey
+	log  Logger
+}
+
+// NewAPIKeys returns an empty set of API keys.
+func NewAPIKeys() *APIKeys {
+	return &APIKeys{keys: make(map[string]*APIKey)}
+}
+
+// Add accepts a key given its hash.
+func (a *APIKeys) Add(hash string, key *APIKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[strings.ToLower(hash)] = key
+}
+
+// Remove revokes a key given its hash.
+func (a *APIKeys) Remove(hash string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.keys, strings.ToLower(hash))
+}
+
+// Lookup returns the key matching a key presented by a caller.
+func (a *APIKeys) Lookup(key string) *APIKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.keys[HashAPIKey(key)]
+}
+
+// Follow keeps the keys in step with a store of hashed keys.
+func (a *APIKeys) Follow(store *Store) {
+	store.OnChange(func(hash, value string, deleted bool) {
+		if deleted {
+			a.Remove(hash)
+			store.logger().Infof("Revoked API key %v", hash)
+			return
+		}
+		key := &APIKey{}
+		if err := json.Unmarshal([]byte(value), key); err != nil {
+			store.logger().Warningf("Invalid API key %v: %v", hash, err)
+			a.Remove(hash)
+			return
+		}
+		a.Add(hash, key)
+		store.logger().Infof("Loaded API key %v for %v", hash, key.Name)
+	})
+}
+
+// ConfigureAPIKeys has exchange load the API keys stored under
+// /gateway/apikeys/<env> in etcd when it is initialized, and pick up keys
+// being added and revoked from the watch that follows service routes and
+// hosts.  It must be called before the exchange's Init.
+func ConfigureAPIKeys(keys *APIKeys, exchange *Exchange) {
+	if exchange.client == nil {
+		return
+	}
+	store := NewStore(GatewayKey("apikeys"), exchange.client)
+	store.log = keys.log
+	keys.Follow(store)
+	exchange.Follow(store)
+}
+
+// presentedAPIKey returns the API key sent with a request, if any.
+func presentedAPIKey(request *http.Request) string {
+	if key := request.Header.Get(XAPIKey); key != "" {
+		return key
+	}
+	return request.URL.Query().Get(apiKeyParam)
+}
+
+// checkAPIKey authenticates a request carrying an API key.
+func (mux *Mux) checkAPIKey(request *http.Request, handler *PatternHandler) (*Principal, error) {
+	presented := presentedAPIKey(request)
+	if presented == "" {
+		return nil, &StatusError{Code: http.StatusUnauthorized, Message: "missing API key"}
+	}
+	key := mux.apiKeys.Lookup(presented)
+	if key == nil {
+		return nil, &StatusError{Code: http.StatusUnauthorized, Message: "invalid API key"}
+	}
+	if !key.allows(handler.Service, handler.Route) {
+		return nil, &StatusError{Code: http.StatusForbidden, Message: "API key " + key.Name + " may not call " + routeName(handler.Route)}
+	}
+	return &Principal{
+		Subject: key.Name,
+		Scheme:  "apikey",
+		Headers: http.Header{XAPIKeyName: {key.Name}},
+	}, nil
+}
+
+// stripAPIKey keeps the caller's API key from reaching the backend.  The
+// rest of the query is passed on byte for byte.
+func stripAPIKey(request *http.Request) {
+	request.Header.Del(XAPIKey)
+	if request.URL.RawQuery == "" {
+		return
+	}
+	params := strings.Split(request.URL.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == apiKeyParam {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	request.URL.RawQuery = strings.Join(kept, "&")
+}
@@ -0,0 +1,115 @@
+package moria_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+// newAPIKeyGateway serves two API key routes of the orders service from a
+// backend echoing the key name and query string it receives, with keys
+// followed from etcd by an exchange.
+func newAPIKeyGateway(t *testing.T, keys *fakeKeys) *moria.Mux {
+	t.Setenv("VINE_ENV", "test")
+	mux := newRoutedMux(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/orders", APIKey: true},
+		{Method: "POST", Path: "/orders", APIKey: true},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(moria.XAPIKeyName) + "|" + r.Header.Get(moria.XAPIKey) + "|" + r.URL.RawQuery))
+	}))
+	followAPIKeys(t, keys, mux)
+	return mux
+}
+
+// followAPIKeys has an exchange watching keys keep the API keys of mux
+// current.
+func followAPIKeys(t *testing.T, keys *fakeKeys, mux *moria.Mux) {
+	keys.Set(context.TODO(), "/services/orders/test/routes", "[]", nil)
+	exchange := moria.NewExchange("services", keys, mux)
+	moria.ConfigureAPIKeys(mux.APIKeys(), exchange)
+	if err := exchange.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go exchange.Watch()
+}
+
+func storeAPIKey(keys *fakeKeys, key, name string, scopes ...string) {
+	value, _ := json.Marshal(moria.APIKey{Name: name, Scopes: scopes})
+	keys.Set(context.TODO(), "/gateway/apikeys/test/"+moria.HashAPIKey(key), string(value), nil)
+}
+
+func callWithAPIKey(mux *moria.Mux, method, url string, header http.Header) (int, string) {
+	recorder := serve(mux, method, url, nil, header)
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestAPIKeyHeaderAndQuery(t *testing.T) {
+	keys := newFakeKeys()
+	storeAPIKey(keys, "acme-secret", "acme", "test-service")
+	mux := newAPIKeyGateway(t, keys)
+
+	status, body := callWithAPIKey(mux, "GET", "http://gateway/api/orders?page=2", http.Header{"X-Api-Key": {"acme-secret"}, "X-Api-Key-Name": {"spoofed"}})
+	if status != http.StatusOK || body != "acme||page=2" {
+		t.Errorf("Expected 200 acme||page=2 got %d %v", status, body)
+	}
+	status, body = callWithAPIKey(mux, "GET", "http://gateway/api/orders?api_key=acme-secret&page=2", nil)
+	if status != http.StatusOK || body != "acme||page=2" {
+		t.Errorf("Expected the query key to be accepted and stripped got %d %v", status, body)
+	}
+	status, body = callWithAPIKey(mux, "GET", "http://gateway/api/orders?z=1&q=a%20b+c&api%5Fkey=acme-secret&a=%2F&z=0", nil)
+	if status != http.StatusOK || body != "acme||z=1&q=a%20b+c&a=%2F&z=0" {
+		t.Errorf("Expected the rest of the query to be passed on untouched got %d %v", status, body)
+	}
+}
+
+func TestAPIKeyRejected(t *testing.T) {
+	keys := newFakeKeys()
+	storeAPIKey(keys, "acme-secret", "acme", "billing")
+	mux := newAPIKeyGateway(t, keys)
+
+	if status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a key got %d", status)
+	}
+	if status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", http.Header{"X-Api-Key": {"guess"}}); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown key got %d", status)
+	}
+	if status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", http.Header{"X-Api-Key": {"acme-secret"}}); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a key scoped to another service got %d", status)
+	}
+}
+
+func TestAPIKeyRouteScope(t *testing.T) {
+	keys := newFakeKeys()
+	storeAPIKey(keys, "reader", "reader", "test-service:GET /orders")
+	mux := newAPIKeyGateway(t, keys)
+
+	header := http.Header{"X-Api-Key": {"reader"}}
+	if status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", header); status != http.StatusOK {
+		t.Errorf("Expected 200 on the scoped route got %d", status)
+	}
+	if status, _ := callWithAPIKey(mux, "POST", "http://gateway/api/orders", header); status != http.StatusForbidden {
+		t.Errorf("Expected 403 on another route got %d", status)
+	}
+}
+
+func TestAPIKeyRevocation(t *testing.T) {
+	keys := newFakeKeys()
+	storeAPIKey(keys, "acme-secret", "acme", "*")
+	mux := newAPIKeyGateway(t, keys)
+
+	header := http.Header{"X-Api-Key": {"acme-secret"}}
+	if status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", header); status != http.StatusOK {
+		t.Fatalf("Expected 200 before revocation got %d", status)
+	}
+	keys.Delete(context.TODO(), "/gateway/apikeys/test/"+moria.HashAPIKey("acme-secret"), nil)
+	eventually(t, func() bool {
+		status, _ := callWithAPIKey(mux, "GET", "http://gateway/api/orders", header)
+		return status == http.StatusUnauthorized
+	})
+	if watched := keys.watched(); len(watched) != 1 || watched[0] != "/" {
+		t.Errorf("Expected keys to be followed by the exchange's watch alone got watches on %v", watched)
+	}
+}
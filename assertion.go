@@ -0,0 +1,206 @@
+package moria
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// XGatewayAssertion carries the token vouching for a request's caller.
+	XGatewayAssertion = "X-Gateway-Assertion"
+	// XRequestID identifies a request across the gateway and backends.
+	XRequestID = "X-Request-Id"
+	// AssertionJWKSPath is where the gateway publishes the public key
+	// backends verify assertions with.
+	AssertionJWKSPath = "/.well-known/gateway-jwks.json"
+
+	defaultAssertionIssuer = "moria"
+	defaultAssertionTTL    = time.Minute
+)
+
+// AssertionSigner mints short-lived JWTs telling backends who the gateway
+// authenticated a request as.  Backends verify them with the key published at
+// AssertionJWKSPath rather than trusting identity headers.
+type AssertionSigner struct {
+	key    crypto.Signer
+	alg    string
+	kid    string
+	issuer string
+	ttl    time.Duration
+}
+
+// NewAssertionSigner creates a signer from a PEM encoded RSA or P-256 private
+// key, signing with RS256 or ES256 respectively.
+func NewAssertionSigner(keyPEM []byte, issuer string, ttl time.Duration) (*AssertionSigner, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &AssertionSigner{issuer: issuer, ttl: ttl}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.key, s.alg = k, "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("assertion keys must use P-256")
+		}
+		s.key, s.alg = k, "ES256"
+	default:
+		return nil, fmt.Errorf("unsupported assertion key type %T", key)
+	}
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	s.kid = base64.RawURLEncoding.EncodeToString(sum[:12])
+	return s, nil
+}
+
+// AssertionSignerFromEnv loads the signing key from ASSERTION_KEY_PATH, or
+// from ASSERTION_KEY_STRING with escaped newlines.  ASSERTION_ISSUER and
+// ASSERTION_TTL override the iss claim and the token lifetime.  It returns
+// nil if no key is configured.
+func AssertionSignerFromEnv() (*AssertionSigner, error) {
+	keyPEM := pemFromEnv("ASSERTION_KEY_STRING")
+	if path := os.Getenv("ASSERTION_KEY_PATH"); path != "" {
+		var err error
+		if keyPEM, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(keyPEM) == 0 {
+		return nil, nil
+	}
+	issuer := os.Getenv("ASSERTION_ISSUER")
+	if issuer == "" {
+		issuer = defaultAssertionIssuer
+	}
+	ttl, err := time.ParseDuration(os.Getenv("ASSERTION_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultAssertionTTL
+	}
+	return NewAssertionSigner(keyPEM, issuer, ttl)
+}
+
+// Sign returns a compact JWT holding claims along with the issuer, issue and
+// expiry times.
+func (s *AssertionSigner) Sign(claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	claims["iss"] = s.issuer
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(s.ttl).Unix()
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, digest[:]); err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// PublicJWKS returns the JWKS document backends verify assertions with.
+func (s *AssertionSigner) PublicJWKS() []byte {
+	key := map[string]string{"kid": s.kid, "alg": s.alg, "use": "sig"}
+	switch public := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		key["kty"] = "RSA"
+		key["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key["kty"] = "EC"
+		key["crv"] = "P-256"
+		key["x"] = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+		key["y"] = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+	}
+	document, _ := json.Marshal(map[string]interface{}{"keys": []interface{}{key}})
+	return document
+}
+
+// requestID returns the ID of a request, creating one if the client did not
+// send it.
+func requestID(request *http.Request) string {
+	if id := request.Header.Get(XRequestID); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	request.Header.Set(XRequestID, id)
+	return id
+}
+
+// setAssertion attaches an identity assertion to a request to a backend when
+// the gateway has authenticated the caller.  A copy sent by the client is
+// always removed.
+func (mux *Mux) setAssertion(innerRequest *http.Request, handler *PatternHandler, principal *Principal) {
+	innerRequest.Header.Del(XGatewayAssertion)
+	if mux.assertions == nil || principal == nil {
+		return
+	}
+	token, err := mux.assertions.Sign(map[string]interface{}{
+		"sub":   principal.Subject,
+		"aud":   handler.Service,
+		"auth":  principal.Scheme,
+		"route": routeName(handler.Route),
+		"rid":   requestID(innerRequest),
+	})
+	if err != nil {
+		mux.ctx.log.Errorf("Unable to sign identity assertion: %v", err)
+		return
+	}
+	innerRequest.Header.Set(XGatewayAssertion, token)
+}
+
+// serveAssertionJWKS publishes the assertion signing key.
+func (mux *Mux) serveAssertionJWKS(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=300")
+	writer.Write(mux.assertions.PublicJWKS())
+}
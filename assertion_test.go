@@ -0,0 +1,176 @@
+package moria_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// withAssertionKey configures the gateway to sign assertions with key for
+// muxes created during the test.
+func withAssertionKey(t *testing.T, key crypto.Signer) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	t.Setenv("ASSERTION_KEY_STRING", strings.Replace(string(block), "\n", "\\n", -1))
+	t.Setenv("ASSERTION_ISSUER", "edge")
+}
+
+// newAssertionGateway serves an API key route and an anonymous route from a
+// backend echoing the assertion and request ID it receives.
+func newAssertionGateway(t *testing.T) *moria.Mux {
+	keys := newFakeKeys()
+	storeAPIKey(keys, "acme-secret", "acme", "*")
+	t.Setenv("VINE_ENV", "test")
+	mux := newRoutedMux(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/orders", APIKey: true},
+		{Method: "GET", Path: "/status"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(moria.XGatewayAssertion) + "|" + r.Header.Get(moria.XRequestID)))
+	}))
+	store := moria.NewStore(moria.GatewayKey("apikeys"), keys)
+	mux.APIKeys().Follow(store)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+// verifyAssertion checks an ES256 assertion against the gateway's published
+// key and returns its claims.
+func verifyAssertion(t *testing.T, mux *moria.Mux, token string) map[string]interface{} {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", moria.AssertionJWKSPath, nil))
+	var jwks struct {
+		Keys []struct{ Kty, Crv, X, Y, Kid string }
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("Expected one published key got %v %v", recorder.Body.String(), err)
+	}
+	jwk := jwks.Keys[0]
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a compact JWT got %q", token)
+	}
+	var header struct{ Alg, Kid string }
+	decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(decoded, &header)
+	if header.Alg != "ES256" || header.Kid != jwk.Kid {
+		t.Errorf("Expected ES256 signed with %v got %+v", jwk.Kid, header)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(signature) != 64 || !ecdsa.Verify(public, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Fatal("Assertion signature does not verify")
+	}
+	claims := make(map[string]interface{})
+	decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(decoded, &claims)
+	return claims
+}
+
+func TestAssertionAttached(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	withAssertionKey(t, key)
+	mux := newAssertionGateway(t)
+
+	status, body := callWithAPIKey(mux, "GET", "http://gateway/api/orders", http.Header{
+		"X-Api-Key":           {"acme-secret"},
+		"X-Request-Id":        {"req-1"},
+		"X-Gateway-Assertion": {"forged"},
+	})
+	parts := strings.SplitN(body, "|", 2)
+	if status != http.StatusOK || len(parts) != 2 || parts[1] != "req-1" {
+		t.Fatalf("Expected 200 with the request ID forwarded got %d %v", status, body)
+	}
+	claims := verifyAssertion(t, mux, parts[0])
+	expected := map[string]interface{}{"iss": "edge", "sub": "acme", "aud": "test-service", "auth": "apikey", "route": "GET /orders", "rid": "req-1"}
+	for name, value := range expected {
+		if claims[name] != value {
+			t.Errorf("Expected %v claim %v got %v", name, value, claims[name])
+		}
+	}
+	if exp, _ := claims["exp"].(float64); exp <= float64(time.Now().Unix()) || exp > float64(time.Now().Add(2*time.Minute).Unix()) {
+		t.Errorf("Expected a short-lived assertion got exp %v", claims["exp"])
+	}
+}
+
+func TestAssertionRequestIDGenerated(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	withAssertionKey(t, key)
+	mux := newAssertionGateway(t)
+
+	_, body := callWithAPIKey(mux, "GET", "http://gateway/api/orders", http.Header{"X-Api-Key": {"acme-secret"}})
+	parts := strings.SplitN(body, "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		t.Fatalf("Expected a generated request ID got %v", body)
+	}
+	if claims := verifyAssertion(t, mux, parts[0]); claims["rid"] != parts[1] {
+		t.Errorf("Expected rid %v got %v", parts[1], claims["rid"])
+	}
+}
+
+func TestAssertionAnonymousRoute(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	withAssertionKey(t, key)
+	mux := newAssertionGateway(t)
+
+	status, body := callWithAPIKey(mux, "GET", "http://gateway/api/status", http.Header{"X-Gateway-Assertion": {"forged"}})
+	if status != http.StatusOK || strings.HasPrefix(body, "forged") || strings.SplitN(body, "|", 2)[0] != "" {
+		t.Errorf("Expected no assertion for an anonymous caller got %d %v", status, body)
+	}
+}
+
+func TestAssertionSignerRSA(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der := x509.MarshalPKCS1PrivateKey(key)
+	signer, err := moria.NewAssertionSigner(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), "edge", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signer.Sign(map[string]interface{}{"sub": "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("Expected an RS256 signature got %v", err)
+	}
+	if !strings.Contains(string(signer.PublicJWKS()), `"kty":"RSA"`) {
+		t.Errorf("Expected an RSA JWKS got %s", signer.PublicJWKS())
+	}
+}
+
+func TestAssertionSignerRejectsUnsupportedKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	if _, err := moria.NewAssertionSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), "edge", time.Minute); err == nil {
+		t.Error("Expected P-384 keys to be rejected")
+	}
+	if _, err := moria.NewAssertionSigner([]byte("not a key"), "edge", time.Minute); err == nil {
+		t.Error("Expected garbage to be rejected")
+	}
+}
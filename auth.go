@@ -0,0 +1,76 @@
+package moria
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Subject string      // Who the caller is, e.g. the sub claim of a JWT.
+	Scheme  string      // How the caller authenticated, e.g. "jwt".
+	Headers http.Header // Headers passed to the backend, such as forwarded claims.
+}
+
+// authenticate checks the credentials a route requires.  Routes accepting
+// both a bearer token and an API key take whichever the caller presents.  It returns
+// nil without an error for routes open to anonymous callers.
+func (mux *Mux) authenticate(request *http.Request, handler *PatternHandler) (*Principal, error) {
+	route := handler.Route
+	switch {
+	case route.APIKey && presentedAPIKey(request) != "":
+		return mux.checkAPIKey(request, handler)
+	case route.JWT != nil:
+		return mux.checkJWT(request, route.JWT)
+	case route.Introspect != nil:
+		return mux.checkIntrospection(request, route.Introspect)
+	case route.APIKey:
+		return mux.checkAPIKey(request, handler)
+	}
+	return nil, nil
+}
+
+// authHeaders lists the headers the gateway sets from the principal on a
+// route.  Copies sent by the client are always removed so a caller cannot
+// claim an identity the gateway did not establish.
+func authHeaders(route *EtcdRoute) []string {
+	var names []string
+	if route != nil && route.JWT != nil {
+		for _, header := range route.JWT.Claims {
+			names = append(names, header)
+		}
+	}
+	if route != nil && route.Introspect != nil {
+		names = append(names, XAuthSubject, XAuthScopes)
+	}
+	if route != nil && route.APIKey {
+		names = append(names, XAPIKeyName)
+	}
+	return names
+}
+
+// setPrincipalHeaders replaces the identity headers of a request to a
+// backend with those established by the gateway.
+func setPrincipalHeaders(header http.Header, route *EtcdRoute, principal *Principal) {
+	RemoveHeaders(header, authHeaders(route)...)
+	if principal == nil {
+		return
+	}
+	for name, values := range principal.Headers {
+		header[name] = values
+	}
+}
+
+// bearerError refuses a request for a missing or invalid bearer token, with
+// the challenge RFC 6750 asks for.  code is empty when no token was sent.
+func bearerError(code, description string) *StatusError {
+	challenge := `Bearer realm="moria"`
+	if code != "" {
+		challenge += `, error="` + code + `", error_description=` + strconv.Quote(description)
+	}
+	return &StatusError{
+		Code:    http.StatusUnauthorized,
+		Message: description,
+		Header:  http.Header{"Www-Authenticate": {challenge}},
+	}
+}
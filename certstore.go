@@ -0,0 +1,98 @@
+package moria
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// StoredCertificate is the JSON document kept in etcd for each domain under
+// the certificates gateway key, e.g.
+// /gateway/certificates/production/api.example.com.  Wildcard domains are
+// stored under their wildcard name, e.g. *.example.com.
+type StoredCertificate struct {
+	Cert string `json:"cert"` // PEM encoded certificate chain.
+	Key  string `json:"key"`  // PEM encoded private key.
+}
+
+// CertStore picks the certificate for each TLS connection by the server name
+// the client asked for, falling back to a default certificate.  Domains and
+// their certificates are kept in etcd and picked up as they change.
+type CertStore struct {
+	fallback *KeyPair
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate // Certificates keyed by domain.
+}
+
+// NewCertStore creates a certificate store with an optional default key pair
+// used when no stored certificate matches.
+func NewCertStore(fallback *KeyPair) *CertStore {
+	return &CertStore{fallback: fallback, certs: make(map[string]*tls.Certificate)}
+}
+
+// Follow loads certificates from an etcd store and keeps them current.
+func (cs *CertStore) Follow(store *Store) {
+	store.OnChange(func(domain, value string, deleted bool) {
+		if deleted {
+			cs.Remove(domain)
+			store.logger().Infof("Removed TLS certificate for %v", domain)
+			return
+		}
+		var stored StoredCertificate
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			store.logger().Warningf("Invalid TLS certificate for %v: %v", domain, err)
+			return
+		}
+		if err := cs.Add(domain, []byte(stored.Cert), []byte(stored.Key)); err != nil {
+			store.logger().Warningf("Invalid TLS certificate for %v: %v", domain, err)
+			return
+		}
+		store.logger().Infof("Loaded TLS certificate for %v", domain)
+	})
+}
+
+// Add parses a PEM certificate and key and serves them for domain.
+func (cs *CertStore) Add(domain string, certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.certs[strings.ToLower(domain)] = &cert
+	return nil
+}
+
+// Remove stops serving the certificate for domain.
+func (cs *CertStore) Remove(domain string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.certs, strings.ToLower(domain))
+}
+
+// GetCertificate implements tls.Config.GetCertificate.  An exact match for
+// the server name wins over a wildcard for its parent domain, which wins over
+// the fallback.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		cs.mu.RLock()
+		cert, ok := cs.certs[name]
+		if !ok {
+			if i := strings.Index(name, "."); i > 0 {
+				cert, ok = cs.certs["*"+name[i:]]
+			}
+		}
+		cs.mu.RUnlock()
+		if ok {
+			return cert, nil
+		}
+	}
+	if cs.fallback != nil {
+		return cs.fallback.Certificate(), nil
+	}
+	return nil, errors.New("no certificate for server name " + hello.ServerName)
+}
@@ -0,0 +1,87 @@
+package moria_test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+func serverName(t *testing.T, certs *moria.CertStore, name string) string {
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commonName(t, cert)
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	fallback, err := moria.NewKeyPair("superfake.com.cert", "superfake.com.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := moria.NewCertStore(fallback)
+	certPEM, keyPEM := generateCertPEM(t, "api.example.com")
+	if err := certs.Add("api.example.com", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM = generateCertPEM(t, "*.example.com")
+	if err := certs.Add("*.example.com", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"api.example.com": "api.example.com",
+		"API.example.com": "api.example.com",
+		"www.example.com": "*.example.com",
+		"example.com":     "superfake.com",
+		"other.org":       "superfake.com",
+		"":                "superfake.com",
+	}
+	for name, expected := range cases {
+		if got := serverName(t, certs, name); got != expected {
+			t.Errorf("Expected %v for %q got %v", expected, name, got)
+		}
+	}
+}
+
+func TestCertStoreWithoutFallback(t *testing.T) {
+	certs := moria.NewCertStore(nil)
+	if _, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.com"}); err == nil {
+		t.Error("Expected an error without a matching or default certificate")
+	}
+}
+
+func TestCertStoreFollowsEtcd(t *testing.T) {
+	os.Setenv("VINE_ENV", "test")
+	keys := newFakeKeys()
+	dir := moria.GatewayKey("certificates")
+	store := moria.NewStore(dir, keys)
+	certs := moria.NewCertStore(nil)
+	certs.Follow(store)
+	certPEM, keyPEM := generateCertPEM(t, "one.example.com")
+	js, _ := json.Marshal(moria.StoredCertificate{Cert: string(certPEM), Key: string(keyPEM)})
+	keys.Set(context.TODO(), dir+"/one.example.com", string(js), nil)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go store.Watch()
+	if got := serverName(t, certs, "one.example.com"); got != "one.example.com" {
+		t.Errorf("Expected one.example.com got %v", got)
+	}
+
+	// Rotating a certificate is just another write.
+	certPEM, keyPEM = generateCertPEM(t, "two.example.com")
+	js, _ = json.Marshal(moria.StoredCertificate{Cert: string(certPEM), Key: string(keyPEM)})
+	keys.Set(context.TODO(), dir+"/one.example.com", string(js), nil)
+	eventually(t, func() bool { return serverName(t, certs, "one.example.com") == "two.example.com" })
+
+	keys.Delete(context.TODO(), dir+"/one.example.com", nil)
+	eventually(t, func() bool {
+		_, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "one.example.com"})
+		return err != nil
+	})
+}
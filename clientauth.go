@@ -0,0 +1,147 @@
+package moria
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Headers carrying the verified client certificate identity to backends.
+// Copies sent by clients are always removed.
+const (
+	XClientCertVerified    = "X-Client-Cert-Verified"
+	XClientCertSubject     = "X-Client-Cert-Subject"
+	XClientCertIssuer      = "X-Client-Cert-Issuer"
+	XClientCertSANs        = "X-Client-Cert-Sans"
+	XClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// ClientCertHeaders lists every header the gateway sets from a client
+// certificate.
+var ClientCertHeaders = []string{
+	XClientCertVerified,
+	XClientCertSubject,
+	XClientCertIssuer,
+	XClientCertSANs,
+	XClientCertFingerprint,
+}
+
+// ClientCertPolicy is the per-route client certificate requirement declared
+// in a service's routes JSON, e.g.
+//
+//	{"method": "POST", "path": "/orders", "client_cert": {"required": true, "subjects": ["CN=partner.example.com"]}}
+//
+// Subjects match either the full subject DN or its common name; SANs match
+// DNS names, email addresses, URIs or IP addresses.  When both are given a
+// certificate matching either list is allowed.
+type ClientCertPolicy struct {
+	Required bool     `json:"required"`
+	Subjects []string `json:"subjects,omitempty"`
+	SANs     []string `json:"sans,omitempty"`
+}
+
+// ClientCAs loads the CA bundle used to verify client certificates from
+// TLS_CLIENT_CA_PATH or TLS_CLIENT_CA_STRING.  It returns nil if neither is
+// configured.
+func ClientCAs() (*x509.CertPool, error) {
+	var pemData []byte
+	if path := os.Getenv("TLS_CLIENT_CA_PATH"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pemData = data
+	} else if pemData = pemFromEnv("TLS_CLIENT_CA_STRING"); len(pemData) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("no certificates found in client CA bundle")
+	}
+	return pool, nil
+}
+
+// RequestClientCerts makes config ask clients for a certificate and verify
+// any that is offered against cas.  Routes decide whether one is required.
+func RequestClientCerts(config *tls.Config, cas *x509.CertPool) {
+	config.ClientCAs = cas
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+}
+
+// verifiedClientCert returns the leaf certificate of a verified client chain.
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// checkClientCert enforces a route's client certificate policy.
+func checkClientCert(request *http.Request, policy *ClientCertPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	cert := verifiedClientCert(request.TLS)
+	if cert == nil {
+		if policy.Required {
+			return &StatusError{Code: http.StatusUnauthorized, Message: "client certificate required"}
+		}
+		return nil
+	}
+	if len(policy.Subjects) == 0 && len(policy.SANs) == 0 {
+		return nil
+	}
+	for _, subject := range policy.Subjects {
+		if subject == cert.Subject.String() || subject == cert.Subject.CommonName {
+			return nil
+		}
+	}
+	sans := certSANs(cert)
+	for _, allowed := range policy.SANs {
+		for _, san := range sans {
+			if strings.EqualFold(allowed, san) {
+				return nil
+			}
+		}
+	}
+	return &StatusError{Code: http.StatusForbidden, Message: "client certificate " + cert.Subject.String() + " not allowed"}
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// setClientCertHeaders replaces any client supplied identity headers with
+// the identity of the verified client certificate, if there is one.
+func setClientCertHeaders(header http.Header, state *tls.ConnectionState) {
+	RemoveHeaders(header, ClientCertHeaders...)
+	cert := verifiedClientCert(state)
+	if cert == nil {
+		if state != nil {
+			header.Set(XClientCertVerified, "NONE")
+		}
+		return
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	header.Set(XClientCertVerified, "SUCCESS")
+	header.Set(XClientCertSubject, cert.Subject.String())
+	header.Set(XClientCertIssuer, cert.Issuer.String())
+	header.Set(XClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+	if sans := certSANs(cert); len(sans) != 0 {
+		header.Set(XClientCertSANs, strings.Join(sans, ","))
+	}
+}
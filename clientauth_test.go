@@ -0,0 +1,122 @@
+package moria_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+// echoHeader responds with the value of a request header.
+func echoHeader(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(name)))
+	})
+}
+
+// clientCert returns a self-signed client certificate and a pool trusting it.
+func clientCert(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	certPEM, keyPEM := generateCertPEM(t, commonName)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return cert, pool
+}
+
+// newTLSGateway serves mux over TLS, verifying client certificates from cas.
+func newTLSGateway(mux *moria.Mux, cas *x509.CertPool) *httptest.Server {
+	gateway := httptest.NewUnstartedServer(mux)
+	gateway.TLS = &tls.Config{}
+	moria.RequestClientCerts(gateway.TLS, cas)
+	gateway.StartTLS()
+	return gateway
+}
+
+func getWithCert(t *testing.T, url string, certs ...tls.Certificate) (int, string) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       certs,
+	}}}
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set(moria.XClientCertSubject, "CN=spoofed")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	partner, pool := clientCert(t, "partner.example.com")
+	stranger, _ := clientCert(t, "stranger.example.com")
+	pool.AddCert(mustLeaf(t, stranger))
+
+	routes := []moria.EtcdRoute{
+		{Method: "GET", Path: "/partner", ClientCert: &moria.ClientCertPolicy{Required: true, Subjects: []string{"CN=partner.example.com"}}},
+		{Method: "GET", Path: "/by-san", ClientCert: &moria.ClientCertPolicy{Required: true, SANs: []string{"partner.example.com"}}},
+		{Method: "GET", Path: "/open"},
+	}
+	mux, backend, plain := newGatewayRoutes(t, routes, echoHeader(moria.XClientCertSubject))
+	plain.Close()
+	defer backend.Close()
+	gateway := newTLSGateway(mux, pool)
+	defer gateway.Close()
+
+	cases := []struct {
+		path   string
+		certs  []tls.Certificate
+		status int
+		body   string
+	}{
+		{"/api/partner", nil, http.StatusUnauthorized, ""},
+		{"/api/partner", []tls.Certificate{stranger}, http.StatusForbidden, ""},
+		{"/api/partner", []tls.Certificate{partner}, http.StatusOK, "CN=partner.example.com"},
+		{"/api/by-san", []tls.Certificate{partner}, http.StatusOK, "CN=partner.example.com"},
+		{"/api/by-san", []tls.Certificate{stranger}, http.StatusForbidden, ""},
+		{"/api/open", nil, http.StatusOK, ""},
+		{"/api/open", []tls.Certificate{stranger}, http.StatusOK, "CN=stranger.example.com"},
+	}
+	for _, c := range cases {
+		status, body := getWithCert(t, gateway.URL+c.path, c.certs...)
+		if status != c.status {
+			t.Errorf("%v with %d certs: expected status %d got %d", c.path, len(c.certs), c.status, status)
+		}
+		if status == http.StatusOK && body != c.body {
+			t.Errorf("%v with %d certs: expected subject %q got %q", c.path, len(c.certs), c.body, body)
+		}
+	}
+}
+
+func mustLeaf(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestClientCAsFromEnv(t *testing.T) {
+	pemData, _ := ioutil.ReadFile("superfake.com.cert")
+	os.Setenv("TLS_CLIENT_CA_STRING", strings.Replace(string(pemData), "\n", "\\n", -1))
+	defer os.Unsetenv("TLS_CLIENT_CA_STRING")
+	pool, err := moria.ClientCAs()
+	if err != nil || pool == nil {
+		t.Errorf("Expected a CA pool got %v, %v", pool, err)
+	}
+
+	os.Setenv("TLS_CLIENT_CA_STRING", "not a certificate")
+	if _, err := moria.ClientCAs(); err == nil {
+		t.Error("Expected an error for an invalid bundle")
+	}
+}
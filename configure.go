@@ -18,8 +18,11 @@ func Configure(e string) *Exchange {
 	}
 	etcd := client.NewKeysAPI(c)
 	mux := NewMux()
+	ConfigureJWKS(mux.JWKS(), etcd)
+	ConfigureSecrets(mux.Secrets(), etcd)
 	namespace := Namespace()
 	exchange := NewExchange(namespace, etcd, mux)
+	ConfigureAPIKeys(mux.APIKeys(), exchange)
 	exchange.Init()
 
 	// Watch for service changes in etcd.  The exchange updates service
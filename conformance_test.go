@@ -0,0 +1,229 @@
+package moria_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests in this file check the gateway follows HTTP/1.1 proxy rules
+// (RFC 7230) against a local backend.
+
+func TestConformanceRequestHopHeaders(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/headers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Upgrade", "X-Hop", "Te"} {
+			if v := r.Header.Get(name); v != "" {
+				http.Error(w, name+" forwarded: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		if r.Header.Get("X-End-To-End") != "kept" {
+			http.Error(w, "end-to-end header dropped", http.StatusBadRequest)
+		}
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	request, _ := http.NewRequest("GET", gateway.URL+"/api/headers", nil)
+	request.Header.Set("Connection", "X-Hop")
+	request.Header.Set("X-Hop", "dropped")
+	request.Header.Set("Keep-Alive", "timeout=5")
+	request.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	request.Header.Set("Te", "gzip")
+	request.Header.Set("X-End-To-End", "kept")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 got %d %s", response.StatusCode, body)
+	}
+}
+
+func TestConformanceTeTrailers(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/te", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Te")))
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	request, _ := http.NewRequest("GET", gateway.URL+"/api/te", nil)
+	request.Header.Set("Te", "gzip, trailers")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "trailers" {
+		t.Errorf("Expected Te: trailers to be forwarded got %q", body)
+	}
+}
+
+func TestConformanceResponseHopHeaders(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/headers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "dropped")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-End-To-End", "kept")
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/api/headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	for _, name := range []string{"X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if v := response.Header.Get(name); v != "" {
+			t.Errorf("Expected %v to be removed got %q", name, v)
+		}
+	}
+	if response.Header.Get("X-End-To-End") != "kept" {
+		t.Error("Expected end-to-end response header to be kept")
+	}
+}
+
+func TestConformanceAnnouncedTrailers(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/trailers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/api/trailers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, announced := response.Trailer["X-Checksum"]; !announced {
+		t.Errorf("Expected X-Checksum to be announced got %v", response.Trailer)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "body" || response.Trailer.Get("X-Checksum") != "abc123" {
+		t.Errorf("Expected body with X-Checksum trailer got %q %v", body, response.Trailer)
+	}
+}
+
+func TestConformanceUnannouncedTrailers(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/trailers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Announced")
+		w.Write([]byte("body"))
+		w.Header().Set("X-Announced", "1")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "2")
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/api/trailers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.Trailer.Get("X-Announced") != "1" || response.Trailer.Get("X-Late") != "2" {
+		t.Errorf("Expected both trailers got %v", response.Trailer)
+	}
+}
+
+func TestConformanceRequestTrailers(t *testing.T) {
+	_, backend, gateway := newGateway(t, "POST", "/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Trailer.Get("X-Checksum")))
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	body, writer := io.Pipe()
+	request, _ := http.NewRequest("POST", gateway.URL+"/api/upload", body)
+	request.Trailer = http.Header{"X-Checksum": nil}
+	go func() {
+		writer.Write([]byte("data"))
+		request.Trailer.Set("X-Checksum", "abc123")
+		writer.Close()
+	}()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(got) != "abc123" {
+		t.Errorf("Expected request trailer to reach the backend got %q", got)
+	}
+}
+
+// sendExpectContinue writes a request announcing a body with
+// "Expect: 100-continue" and returns the first status line the gateway sends
+// back, without sending the body.
+func sendExpectContinue(t *testing.T, addr, path string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "POST "+path+" HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, strings.TrimSpace(line)
+}
+
+func TestConformanceExpectContinueAccepted(t *testing.T) {
+	_, backend, gateway := newGateway(t, "POST", "/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	addr := strings.TrimPrefix(gateway.URL, "http://")
+	conn, reader, line := sendExpectContinue(t, addr, "/api/upload")
+	defer conn.Close()
+	if line != "HTTP/1.1 100 Continue" {
+		t.Fatalf("Expected 100 Continue before the body got %q", line)
+	}
+	reader.ReadString('\n')
+	io.WriteString(conn, "data")
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "data" {
+		t.Errorf("Expected 200 data got %d %q", response.StatusCode, body)
+	}
+}
+
+func TestConformanceExpectContinueRejected(t *testing.T) {
+	for _, dump := range []string{"false", "true"} {
+		os.Setenv("DUMP_BODIES", dump)
+		_, backend, gateway := newGateway(t, "POST", "/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+		}))
+		os.Unsetenv("DUMP_BODIES")
+
+		addr := strings.TrimPrefix(gateway.URL, "http://")
+		conn, _, line := sendExpectContinue(t, addr, "/api/upload")
+		if line != "HTTP/1.1 413 Request Entity Too Large" {
+			t.Errorf("Expected the backend's 413 without sending the body (DUMP_BODIES=%v) got %q", dump, line)
+		}
+		conn.Close()
+		backend.Close()
+		gateway.Close()
+	}
+}
@@ -0,0 +1,218 @@
+package moria
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS request and response headers.
+const (
+	Origin                        = "Origin"
+	Vary                          = "Vary"
+	AccessControlRequestMethod    = "Access-Control-Request-Method"
+	AccessControlRequestHeaders   = "Access-Control-Request-Headers"
+	AccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	AccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	AccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	AccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	AccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	AccessControlMaxAge           = "Access-Control-Max-Age"
+)
+
+// corsHeaders are the response headers the gateway owns on routes with a
+// CORS policy.  Whatever a backend sends for them is discarded.
+var corsHeaders = []string{
+	AccessControlAllowOrigin,
+	AccessControlAllowMethods,
+	AccessControlAllowHeaders,
+	AccessControlAllowCredentials,
+	AccessControlExposeHeaders,
+	AccessControlMaxAge,
+}
+
+// CORSPolicy is the cross-origin policy for a service, set as the "cors"
+// section of its config, or for a single route, e.g.
+//
+//	{"cors": {"origins": ["https://app.example.com", "https://*.example.com"], "headers": ["Authorization", "Content-Type"], "credentials": true, "max_age": 600}}
+//
+// Routes with a policy have their preflight requests answered by the gateway
+// and the CORS headers of their responses set by it.
+type CORSPolicy struct {
+	Origins     []string `json:"origins"`                  // Allowed origins; "*" allows any without Credentials, "https://*.example.com" any subdomain.
+	Methods     []string `json:"methods,omitempty"`        // Allowed methods, the route's own method by default.
+	Headers     []string `json:"headers,omitempty"`        // Allowed request headers; "*" allows any.
+	Expose      []string `json:"expose_headers,omitempty"` // Response headers scripts may read.
+	Credentials bool     `json:"credentials,omitempty"`    // Allow cookies and authorization headers.
+	MaxAge      int      `json:"max_age,omitempty"`        // Seconds browsers may cache a preflight.
+}
+
+// corsPolicy returns the policy for a route, which overrides its service's.
+func (mux *Mux) corsPolicy(handler *PatternHandler) *CORSPolicy {
+	if handler.Route != nil && handler.Route.CORS != nil {
+		return handler.Route.CORS
+	}
+	if config := mux.serviceConfig(handler.Service); config != nil {
+		return config.CORS
+	}
+	return nil
+}
+
+// isPreflight reports whether a request is a CORS preflight.
+func isPreflight(request *http.Request) bool {
+	return request.Method == http.MethodOptions &&
+		request.Header.Get(Origin) != "" &&
+		request.Header.Get(AccessControlRequestMethod) != ""
+}
+
+// servePreflight answers a preflight for a route with a CORS policy.  It
+// returns false, leaving the request to be proxied, for routes without one.
+func (mux *Mux) servePreflight(writer http.ResponseWriter, request *http.Request) bool {
+	method := request.Header.Get(AccessControlRequestMethod)
+	handler, err := mux.match(method, request.URL.Path)
+	if err != nil {
+		return false
+	}
+	policy := mux.corsPolicy(handler)
+	if policy == nil {
+		return false
+	}
+	// Clients the route refuses by address learn nothing about its policy.
+	if err := mux.checkIP(request, handler); err != nil {
+		mux.ctx.log.Warningf("Refused preflight for %v %v: %v", method, request.URL.Path, err)
+		mux.ctx.errHandler.ServeHTTP(writer, request, err)
+		return true
+	}
+	origin := request.Header.Get(Origin)
+	header := writer.Header()
+	header.Add(Vary, "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	requested := splitHeaderList(request.Header[AccessControlRequestHeaders])
+	if !policy.allowsOrigin(origin) || !policy.allowsMethod(method) || !policy.allowsHeaders(requested) {
+		mux.ctx.log.Warningf("Refused preflight for %v %v from %v", method, request.URL.Path, origin)
+		writer.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	policy.setOrigin(header, origin)
+	if len(policy.Methods) > 0 {
+		header.Set(AccessControlAllowMethods, strings.Join(policy.Methods, ", "))
+	} else {
+		header.Set(AccessControlAllowMethods, method)
+	}
+	if len(requested) > 0 {
+		header.Set(AccessControlAllowHeaders, strings.Join(requested, ", "))
+	}
+	if policy.MaxAge > 0 {
+		header.Set(AccessControlMaxAge, strconv.Itoa(policy.MaxAge))
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// setCORSHeaders replaces the CORS headers of a response with those of the
+// route's policy.  Responses to origins the policy does not allow carry none.
+func (mux *Mux) setCORSHeaders(header http.Header, request *http.Request, handler *PatternHandler) {
+	policy := mux.corsPolicy(handler)
+	if policy == nil {
+		return
+	}
+	RemoveHeaders(header, corsHeaders...)
+	origin := request.Header.Get(Origin)
+	if origin == "" {
+		return
+	}
+	header.Add(Vary, Origin)
+	if !policy.allowsOrigin(origin) {
+		return
+	}
+	policy.setOrigin(header, origin)
+	if len(policy.Expose) > 0 {
+		header.Set(AccessControlExposeHeaders, strings.Join(policy.Expose, ", "))
+	}
+}
+
+// setOrigin allows an origin, which must have passed allowsOrigin.  Requests
+// with credentials must be answered with the origin itself rather than "*".
+func (policy *CORSPolicy) setOrigin(header http.Header, origin string) {
+	if policy.Credentials {
+		header.Set(AccessControlAllowOrigin, origin)
+		header.Set(AccessControlAllowCredentials, "true")
+		return
+	}
+	for _, allowed := range policy.Origins {
+		if allowed == "*" {
+			header.Set(AccessControlAllowOrigin, "*")
+			return
+		}
+	}
+	header.Set(AccessControlAllowOrigin, origin)
+}
+
+// allowsOrigin checks an origin against the policy.  With credentials, only
+// the origins listed are allowed: echoing any origin back would let every
+// site make requests with the user's cookies.
+func (policy *CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range policy.Origins {
+		if allowed == "*" && policy.Credentials {
+			continue
+		}
+		if originMatches(strings.ToLower(allowed), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches compares an origin with an allowed pattern.  A "*" in the
+// pattern stands for one or more host name labels, so "https://*.example.com"
+// matches https://api.example.com but not https://example.com or
+// https://evil.com/.example.com.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return false
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	for _, r := range origin[len(prefix) : len(origin)-len(suffix)] {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsMethod checks a method against the policy.  Without a list, the
+// method of the route the preflight matched is allowed.
+func (policy *CORSPolicy) allowsMethod(method string) bool {
+	if len(policy.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range policy.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *CORSPolicy) allowsHeaders(requested []string) bool {
+	for _, name := range requested {
+		allowed := false
+		for _, h := range policy.Headers {
+			if h == "*" || strings.EqualFold(h, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
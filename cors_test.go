@@ -0,0 +1,158 @@
+package moria_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+var appCORS = &moria.CORSPolicy{
+	Origins:     []string{"https://app.example.com", "https://*.partners.example.com"},
+	Headers:     []string{"Authorization", "Content-Type"},
+	Expose:      []string{"X-Total-Count"},
+	Credentials: true,
+	MaxAge:      600,
+}
+
+// newCORSGateway serves routes of a service with the given CORS policy from
+// a backend that answers with its own, permissive, CORS headers.
+func newCORSGateway(t *testing.T, policy *moria.CORSPolicy, routes []moria.EtcdRoute) (*moria.Mux, func()) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		w.Write([]byte(r.Method))
+	}))
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &moria.ServiceRecord{ID: "cors-1", Name: "cors", Address: u.Host, Config: &moria.ServiceConfig{CORS: policy}}
+	record.GenerateRecord(routes)
+	mux := moria.NewMux()
+	register(mux, record)
+	return mux, backend.Close
+}
+
+func preflight(mux *moria.Mux, path, origin, method, headers string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("OPTIONS", "http://gateway"+path, nil)
+	request.Header.Set("Origin", origin)
+	request.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		request.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCORSPreflight(t *testing.T) {
+	mux, stop := newCORSGateway(t, appCORS, []moria.EtcdRoute{{Method: "GET", Path: "/orders"}, {Method: "DELETE", Path: "/orders/:id"}})
+	defer stop()
+
+	recorder := preflight(mux, "/api/orders/7", "https://eu.partners.example.com", "DELETE", "authorization, content-type")
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://eu.partners.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "DELETE",
+		"Access-Control-Allow-Headers":     "authorization, content-type",
+		"Access-Control-Max-Age":           "600",
+	}
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected the gateway to answer the preflight with 204 got %d %v", recorder.Code, recorder.Body)
+	}
+	for name, value := range expected {
+		if got := recorder.Header().Get(name); got != value {
+			t.Errorf("Expected %v: %v got %q", name, value, got)
+		}
+	}
+}
+
+func TestCORSPreflightRefused(t *testing.T) {
+	mux, stop := newCORSGateway(t, appCORS, []moria.EtcdRoute{{Method: "GET", Path: "/orders"}})
+	defer stop()
+
+	cases := map[string]*httptest.ResponseRecorder{
+		"origin":          preflight(mux, "/api/orders", "https://evil.example.org", "GET", ""),
+		"wildcard depth":  preflight(mux, "/api/orders", "https://partners.example.com", "GET", ""),
+		"wildcard escape": preflight(mux, "/api/orders", "https://evil.com/.partners.example.com", "GET", ""),
+		"header":          preflight(mux, "/api/orders", "https://app.example.com", "GET", "X-Debug"),
+	}
+	for name, recorder := range cases {
+		if recorder.Code != http.StatusForbidden || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%v: expected 403 without CORS headers got %d %v", name, recorder.Code, recorder.Header())
+		}
+	}
+}
+
+func TestCORSPreflightChecksClientIP(t *testing.T) {
+	mux, stop := newCORSGateway(t, appCORS, []moria.EtcdRoute{{Method: "GET", Path: "/orders", IP: &moria.IPPolicy{Allow: []string{"10.0.0.0/8"}}}})
+	defer stop()
+
+	recorder := preflight(mux, "/api/orders", "https://app.example.com", "GET", "")
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected 403 without CORS headers for a refused address got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestCORSCredentialsIgnoreAnyOrigin(t *testing.T) {
+	policy := &moria.CORSPolicy{Origins: []string{"*", "https://app.example.com"}, Credentials: true}
+	mux, stop := newCORSGateway(t, policy, []moria.EtcdRoute{{Method: "GET", Path: "/orders"}})
+	defer stop()
+
+	if recorder := preflight(mux, "/api/orders", "https://evil.example.org", "GET", ""); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected an unlisted origin to be refused with credentials got %d %v", recorder.Code, recorder.Header())
+	}
+	request := httptest.NewRequest("GET", "http://gateway/api/orders", nil)
+	request.Header.Set("Origin", "https://evil.example.org")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "" || recorder.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Expected no CORS headers for an unlisted origin got %v", recorder.Header())
+	}
+	recorder = preflight(mux, "/api/orders", "https://app.example.com", "GET", "")
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("Expected a listed origin to be allowed got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestCORSResponseHeadersNormalized(t *testing.T) {
+	mux, stop := newCORSGateway(t, appCORS, []moria.EtcdRoute{{Method: "GET", Path: "/orders"}})
+	defer stop()
+
+	request := httptest.NewRequest("GET", "http://gateway/api/orders", nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	header := recorder.Header()
+	if header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || header.Get("Access-Control-Allow-Methods") != "" ||
+		header.Get("Access-Control-Expose-Headers") != "X-Total-Count" || header.Get("Vary") != "Origin" {
+		t.Errorf("Expected the backend's CORS headers replaced by the policy got %v", header)
+	}
+
+	request.Header.Set("Origin", "https://evil.example.org")
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers for a foreign origin got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestCORSRoutePolicy(t *testing.T) {
+	public := &moria.CORSPolicy{Origins: []string{"*"}, Methods: []string{"GET", "HEAD"}}
+	mux, stop := newCORSGateway(t, nil, []moria.EtcdRoute{{Method: "GET", Path: "/catalog", CORS: public}, {Method: "POST", Path: "/orders"}})
+	defer stop()
+
+	recorder := preflight(mux, "/api/catalog", "https://anyone.example", "GET", "")
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		recorder.Header().Get("Access-Control-Allow-Methods") != "GET, HEAD" {
+		t.Errorf("Expected the route policy to answer got %d %v", recorder.Code, recorder.Header())
+	}
+	// Routes of services without a policy leave preflights to the backend.
+	recorder = preflight(mux, "/api/orders", "https://anyone.example", "POST", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected the preflight to be routed as a normal OPTIONS request got %d", recorder.Code)
+	}
+}
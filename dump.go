@@ -0,0 +1,141 @@
+package moria
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// defaultDumpLimit caps how much of each body is captured when dumping.
+const defaultDumpLimit = 4096
+
+// DumpConfig controls the opt-in debug dumping of proxied requests and
+// responses.  Bodies are captured as they stream past, never buffered ahead
+// of the backend or the client, and only the first Limit bytes are kept.
+// Secrets are masked by Redactor, or DefaultRedactor when it is nil.
+type DumpConfig struct {
+	Enabled  bool
+	Limit    int64
+	Redactor *Redactor
+}
+
+// Dumping reads DUMP_BODIES and DUMP_BODY_LIMIT from the environment, and
+// the extra secrets to mask as described by Redaction.
+func Dumping() DumpConfig {
+	cfg := DumpConfig{Limit: defaultDumpLimit, Redactor: Redaction()}
+	cfg.Enabled, _ = strconv.ParseBool(os.Getenv("DUMP_BODIES"))
+	if limit, err := strconv.ParseInt(os.Getenv("DUMP_BODY_LIMIT"), 10, 64); err == nil && limit >= 0 {
+		cfg.Limit = limit
+	}
+	return cfg
+}
+
+// dumpRequest logs the request line and headers and arranges for the first
+// part of the body to be logged once it has been read.
+func (cfg DumpConfig) dumpRequest(log Logger, label string, request *http.Request) {
+	if !cfg.Enabled {
+		return
+	}
+	dump, err := httputil.DumpRequest(cfg.redactor().Request(request), false)
+	if err != nil {
+		log.Errorf("%v: %v", label, err)
+		return
+	}
+	log.Infof("%v: %q", label, dump)
+	if request.Body != nil && request.Body != http.NoBody {
+		request.Body = cfg.newDumpReader(log, label+" body", request.Header.Get("Content-Type"), request.Body)
+	}
+}
+
+// dumpRequestOut logs the request line and headers of an outgoing request.
+// Its body is the incoming request's body, which is already being captured.
+func (cfg DumpConfig) dumpRequestOut(log Logger, label string, request *http.Request) {
+	if !cfg.Enabled {
+		return
+	}
+	dump, err := httputil.DumpRequestOut(cfg.redactor().Request(request), false)
+	if err != nil {
+		log.Errorf("%v: %v", label, err)
+		return
+	}
+	log.Infof("%v: %q", label, dump)
+}
+
+// dumpResponse logs the status line and headers and arranges for the first
+// part of the body to be logged once it has been read.
+func (cfg DumpConfig) dumpResponse(log Logger, label string, response *http.Response) {
+	if !cfg.Enabled {
+		return
+	}
+	dump, err := httputil.DumpResponse(cfg.redactor().Response(response), false)
+	if err != nil {
+		log.Errorf("%v: %v", label, err)
+		return
+	}
+	log.Infof("%v: %q", label, dump)
+	if response.Body != nil {
+		response.Body = cfg.newDumpReader(log, label+" body", response.Header.Get("Content-Type"), response.Body)
+	}
+}
+
+func (cfg DumpConfig) redactor() *Redactor {
+	if cfg.Redactor == nil {
+		return DefaultRedactor
+	}
+	return cfg.Redactor
+}
+
+func (cfg DumpConfig) newDumpReader(log Logger, label, contentType string, rc io.ReadCloser) io.ReadCloser {
+	return &dumpReader{ReadCloser: rc, logger: log, label: label, contentType: contentType, redactor: cfg.redactor(), limit: cfg.Limit}
+}
+
+// dumpReader copies up to limit bytes of everything read through it and logs
+// the capture when the body is exhausted or closed.
+type dumpReader struct {
+	io.ReadCloser
+	logger      Logger
+	label       string
+	contentType string
+	redactor    *Redactor
+	limit       int64
+	total       int64
+	buf         bytes.Buffer
+	once        sync.Once
+}
+
+func (d *dumpReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if n > 0 {
+		if room := d.limit - int64(d.buf.Len()); room > 0 {
+			if int64(n) < room {
+				room = int64(n)
+			}
+			d.buf.Write(p[:room])
+		}
+		d.total += int64(n)
+	}
+	if err == io.EOF {
+		d.log()
+	}
+	return n, err
+}
+
+func (d *dumpReader) Close() error {
+	d.log()
+	return d.ReadCloser.Close()
+}
+
+func (d *dumpReader) log() {
+	d.once.Do(func() {
+		captured := d.redactor.Body(d.contentType, d.buf.Bytes())
+		if d.total > int64(d.buf.Len()) {
+			d.logger.Infof("%v (%d of %d bytes): %q", d.label, d.buf.Len(), d.total, captured)
+			return
+		}
+		d.logger.Infof("%v (%d bytes): %q", d.label, d.total, captured)
+	})
+}
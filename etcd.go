@@ -3,14 +3,12 @@ package moria
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/coreos/etcd/client"
-	"github.com/fatih/color"
 	"golang.org/x/net/context"
 )
 
@@ -101,15 +99,19 @@ func EtcdWatcherOptions(index uint64) *client.WatcherOptions {
 }
 
 func CheckEtcdErrors(err error) {
+	checkEtcdErrors(defaultLogger, err)
+}
+
+func checkEtcdErrors(log Logger, err error) {
 	if err != nil {
 		if err == context.Canceled {
-			ctxCancelled(err)
+			ctxCancelled(log, err)
 		} else if err == context.DeadlineExceeded {
-			ctxDeadlineExceeded(err)
+			ctxDeadlineExceeded(log, err)
 		} else if cerr, ok := err.(*client.ClusterError); ok {
-			clusterError(cerr)
+			clusterError(log, cerr)
 		} else {
-			badCluster(err)
+			badCluster(log, err)
 		}
 	}
 }
@@ -172,8 +174,17 @@ func Host(k string) string {
 
 // EtcdRoute is a route that uses grape export url patterns to store json
 type EtcdRoute struct {
-	Method string `json:"method"`
-	Path   string `json:"path"`
+	Method     string               `json:"method"`
+	Path       string               `json:"path"`
+	Stream     bool                 `json:"stream,omitempty"`      // Flush every chunk of the response immediately.
+	GRPC       bool                 `json:"grpc,omitempty"`        // Path is a gRPC /package.Service/Method, served without /api.
+	ClientCert *ClientCertPolicy    `json:"client_cert,omitempty"` // Client certificate requirements.
+	JWT        *JWTPolicy           `json:"jwt,omitempty"`         // Bearer JWT requirements.
+	APIKey     bool                 `json:"api_key,omitempty"`     // Require a partner API key.
+	Signature  *SignaturePolicy     `json:"signature,omitempty"`   // Require an HMAC signature, as webhooks carry.
+	Introspect *IntrospectionPolicy `json:"introspect,omitempty"`  // Opaque OAuth2 access token requirements.
+	CORS       *CORSPolicy          `json:"cors,omitempty"`        // Cross-origin policy, overriding the service's.
+	IP         *IPPolicy            `json:"ip,omitempty"`          // Client addresses allowed, on top of the service's policy.
 }
 
 // ERRORS
@@ -197,39 +208,22 @@ type BadClusterError struct {
 	Message string
 }
 
-func ctxCancelled(err error) {
-	color.Set(color.FgRed)
-	log.Printf(
-		`*************************** ERROR *******************************
-  CTX WAS CANCELED BY ANOTHER ROUTINE DETAILS BELOW:
-	%+v`, err.Error())
+func ctxCancelled(log Logger, err error) {
+	log.Errorf("etcd request was cancelled: %v", err)
 	panic(&CancelledError{Message: err.Error()})
-
 }
 
-func ctxDeadlineExceeded(err error) {
-	color.Set(color.FgRed)
-	log.Printf(
-		`*************************** ERROR *******************************
-  CTX WAS ATTACHED WITH A DEADLINE AND IT EXCEEDED DETAILS BELOW:
-	%+v`, err.Error())
+func ctxDeadlineExceeded(log Logger, err error) {
+	log.Errorf("etcd request exceeded its deadline: %v", err)
 	panic(&DeadlineExceededError{Message: err.Error()})
 }
 
-func clusterError(err error) {
-	color.Set(color.FgRed)
-	log.Printf(
-		`*************************** ERROR *******************************
-  PROCESS (cerr.Errors) DETAILS BELOW:
-	%+v`, err.Error())
+func clusterError(log Logger, err error) {
+	log.Errorf("etcd cluster error: %v", err)
 	panic(&KeyNotFoundError{Message: err.Error()})
 }
 
-func badCluster(err error) {
-	color.Set(color.FgRed)
-	log.Printf(
-		`*************************** ERROR *******************************
-  DETAILS BELOW:\n%+v`, err.Error())
+func badCluster(log Logger, err error) {
+	log.Errorf("Bad etcd cluster endpoints: %v", err)
 	panic(&BadClusterError{Message: "Bad cluster endpoints"})
-
 }
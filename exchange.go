@@ -3,7 +3,6 @@ package moria
 import (
 	"bytes"
 	"encoding/json"
-	"log"
 	"net"
 	"os"
 	"strings"
@@ -16,23 +15,26 @@ import (
 // Exchange watches for service changes in etcd and update an
 // ExchangeServeMux.
 type Exchange struct {
-	namespace         string                    // The root directory in etcd for services.
-	client            client.KeysAPI            // The etcd client.
-	mux               *Mux                      // The serve mux to keep in sync with etcd.
-	waitIndex         uint64                    // Wait index to use when watching etcd.
-	services          map[string]*ServiceRecord // Currently connected services.
-	serviceNameRoutes map[string]string
+	namespace          string                    // The root directory in etcd for services.
+	client             client.KeysAPI            // The etcd client.
+	mux                *Mux                      // The serve mux to keep in sync with etcd.
+	waitIndex          uint64                    // Wait index to use when watching etcd.
+	services           map[string]*ServiceRecord // Currently connected services.
+	serviceNameRoutes  map[string]string
+	serviceNameConfigs map[string]string
+	stores             []*Store // Gateway settings kept current by the same watch.
 }
 
 // NewExchange creates a new exchange configured to watch for changes in a
 // given etcd directory.
 func NewExchange(namespace string, client client.KeysAPI, mux *Mux) *Exchange {
 	return &Exchange{
-		namespace:         namespace,
-		client:            client,
-		mux:               mux,
-		services:          make(map[string]*ServiceRecord),
-		serviceNameRoutes: make(map[string]string)}
+		namespace:          namespace,
+		client:             client,
+		mux:                mux,
+		services:           make(map[string]*ServiceRecord),
+		serviceNameRoutes:  make(map[string]string),
+		serviceNameConfigs: make(map[string]string)}
 }
 
 // Init fetches service information from etcd and initializes the exchange.
@@ -42,7 +44,7 @@ func (exchange *Exchange) Init() error {
 			var ok bool
 			perr, ok = perr.(error)
 			if !ok {
-				log.Printf("Panicking: %v", perr)
+				exchange.log().Errorf("Panicking: %v", perr)
 			}
 		}
 	}()
@@ -50,21 +52,22 @@ func (exchange *Exchange) Init() error {
 	ctx := context.TODO()
 	services, err := exchange.client.Get(ctx, exchange.namespace, options)
 	if err != nil {
-		CheckEtcdErrors(err)
+		checkEtcdErrors(exchange.log(), err)
 	}
 
 	for _, service := range services.Node.Nodes {
 		for _, environ := range service.Nodes {
 			if EnvMatch(environ.Key) {
-				log.Printf("\n>\tInit Matched Environment: %v", environ.Key)
+				exchange.log().Infof("Found environment %v", environ.Key)
 				var serviceRecord *ServiceRecord
 				var serviceMachines []*Machine
+				var serviceConfig string
 				for _, config := range environ.Nodes {
 					if strings.Compare(Tail(config.Key), "routes") == 0 {
-						log.Printf("\n>\tInit Matched Routes: %v", config.Key)
 						serviceRecord = exchange.load(config.Value, Name(service.Key))
+					} else if strings.Compare(Tail(config.Key), "config") == 0 {
+						serviceConfig = config.Value
 					} else if strings.Compare(Tail(config.Key), "hosts") == 0 {
-						log.Printf("\n>\tInit Matched Hosts: %v", config.Key)
 						for _, host := range config.Nodes {
 							if strings.Compare(host.Value, "") != 0 {
 								serviceMachines = append(serviceMachines, &Machine{Tail(host.Key), host.Value})
@@ -72,6 +75,9 @@ func (exchange *Exchange) Init() error {
 						}
 					}
 				}
+				if serviceRecord != nil {
+					serviceRecord.Config = exchange.loadConfig(serviceConfig, Name(service.Key))
+				}
 				for _, machine := range serviceMachines {
 					serviceRecord.ID = machine.ID
 					serviceRecord.Address = machine.IP
@@ -82,12 +88,53 @@ func (exchange *Exchange) Init() error {
 		}
 	}
 
+	// Changes made to the stores since the services were read are replayed
+	// by the watch.
+	for _, store := range exchange.stores {
+		if err := store.Init(); err != nil {
+			exchange.log().Errorf("Unable to load %v from etcd: %v", store.dir, err)
+		}
+	}
+
 	// We want to watch changes *after* this one.
 	exchange.waitIndex = services.Index + 1
 
 	return nil
 }
 
+// Follow keeps store current from the exchange's own watch rather than one of
+// its own, widening the watch to the closest directory holding both the
+// services and the store.  It must be called before Init.
+func (exchange *Exchange) Follow(store *Store) {
+	exchange.stores = append(exchange.stores, store)
+}
+
+// watchDir returns the directory watched for changes to the services
+// namespace and the stores the exchange follows.
+func (exchange *Exchange) watchDir(ns string) string {
+	dir := "/" + strings.Trim(ns, "/")
+	for _, store := range exchange.stores {
+		for dir != "/" && store.dir != dir && !strings.HasPrefix(store.dir, dir+"/") {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			if dir == "" {
+				dir = "/"
+			}
+		}
+	}
+	return dir
+}
+
+// eventKey returns the key a watch event is about.
+func eventKey(response *client.Response) string {
+	if response.Node != nil {
+		return response.Node.Key
+	}
+	if response.PrevNode != nil {
+		return response.PrevNode.Key
+	}
+	return ""
+}
+
 type Machine struct {
 	ID, IP string
 }
@@ -133,7 +180,8 @@ func EnvKey(s string) string {
 func (exchange *Exchange) Watch() {
 	ns := Namespace()
 	opts := EtcdWatcherOptions(exchange.waitIndex)
-	watcher := exchange.client.Watcher(ns, opts)
+	watcher := exchange.client.Watcher(exchange.watchDir(ns), opts)
+	services := "/" + strings.Trim(ns, "/") + "/"
 	for true {
 		response, err := watcher.Next(context.TODO())
 		// if response.Node != nil {
@@ -144,39 +192,33 @@ func (exchange *Exchange) Watch() {
 		// 	log.Printf("\n>\tRESPONDING TO:%v\n", response.Action)
 		// }
 		if err != nil {
-			log.Printf("\n>RECEIVED ERROR RESPONDING TO:%v\n>\tFOR KEY:%v\n>\tERROR: %+v", response.Action, response.PrevNode.Key, err)
+			exchange.log().Errorf("Error watching %v: %v", ns, err)
+			continue
+		}
+		if exchange.mux != nil {
+			exchange.mux.metrics.watched(response)
+		}
+		key := eventKey(response)
+		followed := false
+		for _, store := range exchange.stores {
+			if store.contains(key) {
+				store.apply(response)
+				followed = true
+			}
+		}
+		if followed || !strings.HasPrefix(key, services) {
 			continue
 		}
 		switch response.Action {
 		case "set", "update", "create", "compareAndSwap":
 			if EnvMatch(response.Node.Key) {
-				if strings.Compare("routes", Tail(response.Node.Key)) == 0 {
-					resp, err := exchange.client.Get(context.TODO(), EnvKey(response.Node.Key), EtcdGetOptions())
-					CheckEtcdErrors(err)
-					environ := resp.Node
-					var serviceRecord *ServiceRecord
-					var serviceMachines []*Machine
-					for _, config := range environ.Nodes {
-						if strings.Compare(Tail(config.Key), "routes") == 0 {
-							serviceRecord = exchange.load(config.Value, Name(response.Node.Key))
-						} else if strings.Compare(Tail(config.Key), "hosts") == 0 {
-							for _, host := range config.Nodes {
-								if strings.Compare(host.Value, "") != 0 {
-									serviceMachines = append(serviceMachines, &Machine{Tail(host.Key), host.Value})
-								}
-							}
-						}
-					}
-					for _, machine := range serviceMachines {
-						serviceRecord.ID = machine.ID
-						serviceRecord.Address = machine.IP
-						serviceRecord.Name = Name(response.Node.Key)
-						exchange.Register(serviceRecord)
-					}
+				if strings.Compare("routes", Tail(response.Node.Key)) == 0 || strings.Compare("config", Tail(response.Node.Key)) == 0 {
+					exchange.reload(response.Node.Key)
 				} else if strings.Compare("hosts", TailMinusOne(response.Node.Key)) == 0 {
 					name := Name(response.Node.Key)
 					if serviceRoutes, ok := exchange.serviceNameRoutes[name]; ok {
 						serviceRecord := exchange.load(serviceRoutes, name)
+						serviceRecord.Config = exchange.loadConfig(exchange.serviceNameConfigs[name], name)
 						serviceRecord.ID = Tail(response.Node.Key)
 						serviceRecord.Address = response.Node.Value
 						serviceRecord.Name = name
@@ -191,28 +233,7 @@ func (exchange *Exchange) Watch() {
 						}
 						exchange.Register(serviceRecord)
 					} else {
-						resp, err := exchange.client.Get(context.TODO(), EnvKey(response.Node.Key), EtcdGetOptions())
-						CheckEtcdErrors(err)
-						environ := resp.Node
-						serviceRecord := &ServiceRecord{}
-						var serviceMachines []*Machine
-						for _, config := range environ.Nodes {
-							if strings.Compare(Tail(config.Key), "routes") == 0 {
-								serviceRecord = exchange.load(config.Value, Name(response.Node.Key))
-							} else if strings.Compare(Tail(config.Key), "hosts") == 0 {
-								for _, host := range config.Nodes {
-									if strings.Compare(host.Value, "") != 0 {
-										serviceMachines = append(serviceMachines, &Machine{Tail(host.Key), host.Value})
-									}
-								}
-							}
-						}
-						for _, machine := range serviceMachines {
-							serviceRecord.ID = machine.ID
-							serviceRecord.Address = machine.IP
-							serviceRecord.Name = Name(response.Node.Key)
-							exchange.Register(serviceRecord)
-						}
+						exchange.reload(response.Node.Key)
 					}
 				}
 			}
@@ -220,7 +241,7 @@ func (exchange *Exchange) Watch() {
 			if EnvMatch(response.PrevNode.Key) {
 				if strings.Compare("routes", Tail(response.PrevNode.Key)) == 0 {
 					resp, err := exchange.client.Get(context.TODO(), EnvKey(response.PrevNode.Key), EtcdGetOptions())
-					CheckEtcdErrors(err)
+					checkEtcdErrors(exchange.log(), err)
 					environ := resp.Node
 					var serviceMachines []*Machine
 					for _, config := range environ.Nodes {
@@ -243,6 +264,8 @@ func (exchange *Exchange) Watch() {
 							exchange.Unregister(service)
 						}
 					}
+				} else if strings.Compare("config", Tail(response.PrevNode.Key)) == 0 {
+					exchange.reload(response.PrevNode.Key)
 				} else if strings.Compare("hosts", TailMinusOne(response.Node.Key)) == 0 {
 					if service, ok := exchange.services[Tail(response.PrevNode.Key)]; ok {
 						exchange.Unregister(service)
@@ -251,11 +274,11 @@ func (exchange *Exchange) Watch() {
 			}
 		}
 		go func(exchange *Exchange) {
-			address, key := gatewayNamespace()
+			address, key := gatewayNamespace(exchange.log())
 			opts := gatewaySetOpts()
 			_, err := exchange.client.Set(context.Background(), key, address, opts)
 			if err != nil {
-				log.Println("ERROR: ", err)
+				exchange.log().Errorf("Unable to publish the gateway address: %v", err)
 			} else {
 				//log.Printf("\n>\t%v \"%v\"\n>\t%v%v", pInfoInline("Success Gateway Alive At:"), pInfoInline(address), pInfoInline("Services May Locate This Gateway At The Key Provided Below\n>\tGATEWAY_KEY="), pInfoInline(resp.Node.Key))
 			}
@@ -264,6 +287,37 @@ func (exchange *Exchange) Watch() {
 	}
 }
 
+// reload fetches the environment directory containing key and registers every
+// host of the service with its current routes and config.
+func (exchange *Exchange) reload(key string) {
+	resp, err := exchange.client.Get(context.TODO(), EnvKey(key), EtcdGetOptions())
+	checkEtcdErrors(exchange.log(), err)
+	environ := resp.Node
+	serviceRecord := &ServiceRecord{}
+	var serviceMachines []*Machine
+	var serviceConfig string
+	for _, config := range environ.Nodes {
+		if strings.Compare(Tail(config.Key), "routes") == 0 {
+			serviceRecord = exchange.load(config.Value, Name(key))
+		} else if strings.Compare(Tail(config.Key), "config") == 0 {
+			serviceConfig = config.Value
+		} else if strings.Compare(Tail(config.Key), "hosts") == 0 {
+			for _, host := range config.Nodes {
+				if strings.Compare(host.Value, "") != 0 {
+					serviceMachines = append(serviceMachines, &Machine{Tail(host.Key), host.Value})
+				}
+			}
+		}
+	}
+	serviceRecord.Config = exchange.loadConfig(serviceConfig, Name(key))
+	for _, machine := range serviceMachines {
+		serviceRecord.ID = machine.ID
+		serviceRecord.Address = machine.IP
+		serviceRecord.Name = Name(key)
+		exchange.Register(serviceRecord)
+	}
+}
+
 // func getEnvironmentKey(s string) {
 //
 // }
@@ -296,26 +350,38 @@ func getIPAddress() string {
 	}
 	return ""
 }
-func gatewayNamespace() (string, string) {
+func gatewayNamespace(log Logger) (string, string) {
 	var host, uName, outputUName, outputHost string
-	var hostErr, uNameErr error
+	var uNameErr error
 	outputUName, uNameErr = os.Hostname()
 	if !strings.Contains(outputUName, ".local") {
 		outputHost = getIPAddress()
 		if uNameErr != nil {
-			log.Printf("\n>\tUnable To Publish Dyno UName\n>\t%+v", hostErr)
+			log.Errorf("Unable to read the hostname: %v", uNameErr)
 		}
 		host = string(outputHost)
 		uName = "/gateway/environments/" + os.Getenv("VINE_ENV") + "/" + string(outputUName)
-		log.Printf("\n>\tUNAME: %v, HOST ADDRESS: %v\n", uName, host)
 	} else {
 		host = "127.0.0.1"
 		uName = "/gateway/environments/" + os.Getenv("VINE_ENV") + "/" + string(outputUName)
-		log.Printf("\n>\tUNAME: %v, HOST ADDRESS: %v\n", uName, host)
 	}
+	withFields(log, Fields{"key": uName, "host": host}).Infof("Publishing the gateway address")
 	return strings.Join([]string{host, ":", os.Getenv("PORT")}, ""), uName
 }
 
+// Mux returns the mux the exchange keeps in sync, e.g. to set its logger.
+func (exchange *Exchange) Mux() *Mux {
+	return exchange.mux
+}
+
+// log returns the logger of the mux the exchange keeps in sync.
+func (exchange *Exchange) log() Logger {
+	if exchange.mux != nil {
+		return exchange.mux.ctx.log
+	}
+	return defaultLogger
+}
+
 func gatewaySetOpts() *client.SetOptions {
 	opts := &client.SetOptions{}
 	opts.Refresh = true
@@ -323,6 +389,21 @@ func gatewaySetOpts() *client.SetOptions {
 	return opts
 }
 
+// loadConfig parses a service's config JSON.  An empty or invalid document
+// yields a nil config, meaning gateway defaults.
+func (exchange *Exchange) loadConfig(js, name string) *ServiceConfig {
+	exchange.serviceNameConfigs[name] = js
+	if js == "" {
+		return nil
+	}
+	var c ServiceConfig
+	if err := json.Unmarshal([]byte(js), &c); err != nil {
+		withFields(exchange.log(), Fields{"service": name}).Errorf("Invalid config: %v", err)
+		return nil
+	}
+	return &c
+}
+
 func (exchange *Exchange) load(js, name string) *ServiceRecord {
 	var routes []EtcdRoute
 	var s ServiceRecord
@@ -336,10 +417,10 @@ func (exchange *Exchange) load(js, name string) *ServiceRecord {
 func (exchange *Exchange) Register(service *ServiceRecord) {
 	exchange.services[service.ID] = service
 	for method, patterns := range service.Routes {
-		for _, pattern := range patterns {
-			pattern = "/api" + pattern
+		for _, path := range patterns {
+			pattern := service.Pattern(method, path)
 			// log.Printf("\n>\tADDING PATTERN\n>\tPATTERN DETAILS: %v %v\n>\tSERVICE DETAILS: %v %v", method, pattern, service.Address, service.ID)
-			exchange.mux.Add(method, pattern, service.Address, service.ID, service, exchange.client)
+			exchange.mux.AddRoute(method, pattern, service.Route(method, path), service.Address, service.ID, service, exchange.client)
 		}
 	}
 }
@@ -349,7 +430,7 @@ func (exchange *Exchange) Unregister(service *ServiceRecord) {
 	for method, patterns := range service.Routes {
 		for _, pattern := range patterns {
 			// log.Printf("\n>\nREMOVING PATTERN\n>\tPATTERN DETAILS: %v %v\n>\tSERVICE DETAILS: %v %v", method, pattern, service.Address, service.ID)
-			exchange.mux.Remove(method, pattern, service.Address, service.ID)
+			exchange.mux.remove(method, service.Pattern(method, pattern), service.Address, service.ID)
 		}
 	}
 }
@@ -0,0 +1,47 @@
+package moria_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+func TestExchangeServiceConfig(t *testing.T) {
+	os.Setenv("VINE_ENV", "test")
+	os.Setenv("NAMESPACE", "services")
+	backend, ca := tlsBackend(schemeHandler)
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "https://")
+
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/services/orders/test/routes", `[{"method":"GET","path":"/orders(.:format)"}]`, nil)
+	keys.Set(context.TODO(), "/services/orders/test/hosts/orders-1", host, nil)
+	mux := moria.NewMux()
+	exchange := moria.NewExchange("services", keys, mux)
+	if err := exchange.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go exchange.Watch()
+	gateway := httptest.NewServer(mux)
+	defer gateway.Close()
+
+	// Plain HTTP to a TLS backend fails until the config says otherwise.
+	if status, _ := get(t, gateway.URL+"/api/orders"); status == http.StatusOK {
+		t.Fatal("Expected plain HTTP to the TLS backend to fail")
+	}
+	config := `{"upstream":{"scheme":"https","server_name":"example.com","ca":` + quote(ca) + `}}`
+	keys.Set(context.TODO(), "/services/orders/test/config", config, nil)
+	eventually(t, func() bool {
+		status, body := get(t, gateway.URL+"/api/orders")
+		return status == http.StatusOK && body == "https"
+	})
+}
+
+func quote(s string) string {
+	return `"` + strings.Replace(s, "\n", `\n`, -1) + `"`
+}
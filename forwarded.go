@@ -0,0 +1,370 @@
+package moria
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Forwarded is the standard header for proxy information (RFC 7239).
+const Forwarded = "Forwarded"
+
+// ForwardedMode chooses which forwarding headers the gateway sends to
+// backends.
+type ForwardedMode string
+
+const (
+	// ForwardedLegacy sends X-Forwarded-For, X-Forwarded-Proto and
+	// X-Forwarded-Host.
+	ForwardedLegacy ForwardedMode = "legacy"
+	// ForwardedStandard sends only the RFC 7239 Forwarded header.
+	ForwardedStandard ForwardedMode = "standard"
+	// ForwardedBoth sends both.
+	ForwardedBoth ForwardedMode = "both"
+)
+
+// ForwardedHeaders reads FORWARDED_HEADERS, one of legacy (the default),
+// standard or both.
+func ForwardedHeaders() ForwardedMode {
+	return forwardedHeaders(defaultLogger)
+}
+
+func forwardedHeaders(log Logger) ForwardedMode {
+	switch mode := ForwardedMode(strings.ToLower(os.Getenv("FORWARDED_HEADERS"))); mode {
+	case ForwardedStandard, ForwardedBoth:
+		return mode
+	case "", ForwardedLegacy:
+	default:
+		log.Warningf("Unknown FORWARDED_HEADERS %q, using legacy", mode)
+	}
+	return ForwardedLegacy
+}
+
+func (m ForwardedMode) legacy() bool {
+	return m != ForwardedStandard
+}
+
+func (m ForwardedMode) standard() bool {
+	return m == ForwardedStandard || m == ForwardedBoth
+}
+
+// TrustedProxies reads TRUSTED_PROXIES, a comma separated list of networks or
+// addresses whose X-Forwarded-* headers are believed, such as the load
+// balancers in front of the gateway.  Requests from anywhere else have those
+// headers replaced.
+func TrustedProxies() []*net.IPNet {
+	return trustedProxies(defaultLogger)
+}
+
+func trustedProxies(log Logger) []*net.IPNet {
+	nets, err := ParseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Warningf("Invalid TRUSTED_PROXIES, trusting no proxies: %v", err)
+		return nil
+	}
+	return nets
+}
+
+// trusts reports whether forwarded headers set by hop, an address from
+// RemoteAddr or a forwarding header, can be believed.
+func (rw *HeaderRewriter) trusts(hop string) bool {
+	if rw.TrustForwardHeader {
+		return true
+	}
+	ip := parseHopIP(hop)
+	return ip != nil && containsIP(rw.TrustedProxies, ip)
+}
+
+// trustsPeer reports whether the direct peer of req is a trusted proxy.
+func (rw *HeaderRewriter) trustsPeer(req *http.Request) bool {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	return err == nil && rw.trusts(peer)
+}
+
+// forwardedElement is one hop of a Forwarded header: the address a proxy
+// received the request from, the interface it received it on, and the
+// protocol and host the request was made with.
+type forwardedElement struct {
+	For, By, Proto, Host string
+}
+
+// forwardedHops returns the hops the request has passed through, starting
+// with the client and ending with the gateway's own.  Trusted peers' hops
+// come from the Forwarded header, unless the gateway only speaks the legacy
+// headers or none was sent, and otherwise from X-Forwarded-For.
+//
+// The chain is walked from the nearest hop back toward the client and ends
+// at the first address that is not a trusted proxy: everything before it
+// could have been made up by the client.
+func (rw *HeaderRewriter) forwardedHops(req *http.Request) []forwardedElement {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	self := forwardedElement{For: peer, By: rw.forwardedBy(req), Proto: "http", Host: req.Host}
+	if req.TLS != nil {
+		self.Proto = "https"
+	}
+	if !rw.trusts(peer) {
+		return []forwardedElement{self}
+	}
+	var hops []forwardedElement
+	if values, ok := req.Header[Forwarded]; ok && rw.Forwarded.standard() {
+		hops = parseForwarded(values)
+	} else {
+		for _, hop := range splitHeaderList(req.Header[XForwardedFor]) {
+			hops = append(hops, forwardedElement{For: hop})
+		}
+	}
+	hops = append(hops, self)
+	for i := len(hops) - 1; i > 0; i-- {
+		if !rw.trusts(hops[i].For) {
+			return hops[i:]
+		}
+	}
+	return hops
+}
+
+// forwardedBy identifies the gateway in the Forwarded header.
+func (rw *HeaderRewriter) forwardedBy(req *http.Request) string {
+	if rw.ForwardedBy != "" {
+		return rw.ForwardedBy
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ip := addrIP(addr); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// forwardedFor returns the addresses in a chain of hops, as they are sent in
+// X-Forwarded-For.
+func forwardedFor(hops []forwardedElement) []string {
+	list := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		list = append(list, nodeHost(hop.For))
+	}
+	return list
+}
+
+// ClientIP returns the address of the client that made req, looking past
+// trusted proxies.
+func (rw *HeaderRewriter) ClientIP(req *http.Request) string {
+	if hops := rw.forwardedHops(req); len(hops) > 0 {
+		return nodeHost(hops[0].For)
+	}
+	return req.RemoteAddr
+}
+
+// rewriteForwarded sets the Forwarded header to the chain of hops.
+func rewriteForwarded(req *http.Request, hops []forwardedElement) {
+	if len(hops) == 0 {
+		req.Header.Del(Forwarded)
+		return
+	}
+	elements := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		elements = append(elements, hop.String())
+	}
+	req.Header.Set(Forwarded, strings.Join(elements, ", "))
+}
+
+// String formats the element for a Forwarded header, quoting values where
+// needed.
+func (e forwardedElement) String() string {
+	var pairs []string
+	for _, pair := range []struct{ name, value string }{
+		{"for", formatNode(e.For)},
+		{"by", formatNode(e.By)},
+		{"proto", e.Proto},
+		{"host", e.Host},
+	} {
+		if pair.value != "" {
+			pairs = append(pairs, pair.name+"="+quoteForwarded(pair.value))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// formatNode writes a node as RFC 7239 requires: IPv6 addresses are
+// enclosed in brackets, while IPv4 addresses, "unknown" and obfuscated
+// identifiers such as _gw1 are used as they are.
+func formatNode(node string) string {
+	if ip := net.ParseIP(node); ip != nil && ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return node
+}
+
+// nodeHost returns the address of a node without its port or brackets, or
+// the node itself if it is "unknown" or an obfuscated identifier.
+func nodeHost(node string) string {
+	if ip := parseHopIP(node); ip != nil {
+		return ip.String()
+	}
+	return node
+}
+
+// quoteForwarded returns value as a token if it is one, and as a quoted
+// string otherwise, as needed for IPv6 addresses and ports.
+func quoteForwarded(value string) string {
+	for i := 0; i < len(value); i++ {
+		if !isTokenChar(value[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// parseForwarded parses the elements of Forwarded headers.  Pairs with
+// unknown names are ignored.  A malformed element counts as a hop from an
+// unknown address, so the chain is never trusted past it.
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, v := range values {
+		p := forwardedParser{s: v}
+		for !p.done() {
+			element, ok := p.element()
+			if !ok {
+				element = forwardedElement{For: "unknown"}
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+type forwardedParser struct {
+	s string
+	i int
+}
+
+func (p *forwardedParser) done() bool {
+	p.skipSpace()
+	return p.i >= len(p.s)
+}
+
+func (p *forwardedParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+// element reads pairs up to the next comma.
+func (p *forwardedParser) element() (forwardedElement, bool) {
+	var e forwardedElement
+	ok := true
+	for {
+		p.skipSpace()
+		start := p.i
+		for p.i < len(p.s) && isTokenChar(p.s[p.i]) {
+			p.i++
+		}
+		name := strings.ToLower(p.s[start:p.i])
+		p.skipSpace()
+		if name == "" || p.i >= len(p.s) || p.s[p.i] != '=' {
+			ok = false
+			p.skipTo(',')
+		} else {
+			p.i++
+			p.skipSpace()
+			value, valid := p.value()
+			ok = ok && valid
+			switch name {
+			case "for":
+				e.For = value
+			case "by":
+				e.By = value
+			case "proto":
+				e.Proto = value
+			case "host":
+				e.Host = value
+			}
+		}
+		p.skipSpace()
+		if p.i >= len(p.s) {
+			return e, ok
+		}
+		c := p.s[p.i]
+		p.i++
+		if c == ',' {
+			return e, ok
+		}
+		if c != ';' {
+			ok = false
+			p.skipTo(',')
+		}
+	}
+}
+
+// value reads a token or a quoted string.
+func (p *forwardedParser) value() (string, bool) {
+	if p.i < len(p.s) && p.s[p.i] == '"' {
+		p.i++
+		var b strings.Builder
+		for p.i < len(p.s) {
+			c := p.s[p.i]
+			p.i++
+			switch c {
+			case '"':
+				return b.String(), true
+			case '\\':
+				if p.i < len(p.s) {
+					b.WriteByte(p.s[p.i])
+					p.i++
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return b.String(), false
+	}
+	start := p.i
+	for p.i < len(p.s) && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i], p.i > start
+}
+
+// skipTo moves to the separator c without consuming it.
+func (p *forwardedParser) skipTo(c byte) {
+	for p.i < len(p.s) && p.s[p.i] != c {
+		if p.s[p.i] == '"' {
+			p.value()
+			continue
+		}
+		p.i++
+	}
+}
+
+// parseHopIP parses an address as it appears in forwarding headers, with or
+// without a port and IPv6 brackets.
+func parseHopIP(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// splitHeaderList splits the comma separated values of a repeated header.
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,199 @@
+package moria_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+func trustedRewriter(t *testing.T, cidrs string) *moria.HeaderRewriter {
+	trusted, err := moria.ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &moria.HeaderRewriter{TrustedProxies: trusted}
+}
+
+func TestRewriterUntrustedPeer(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	req := httptest.NewRequest("GET", "http://gateway.example.com/api/users", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set(moria.XForwardedFor, "1.2.3.4")
+	req.Header.Set(moria.XForwardedProto, "https")
+	req.Header.Set(moria.XForwardedHost, "evil.example.com")
+	rw.Rewrite(req)
+
+	if got := req.Header.Get(moria.XForwardedFor); got != "203.0.113.7" {
+		t.Errorf("Expected spoofed X-Forwarded-For to be replaced got %v", got)
+	}
+	if got := req.Header.Get(moria.XForwardedProto); got != "http" {
+		t.Errorf("Expected X-Forwarded-Proto http got %v", got)
+	}
+	if got := req.Header.Get(moria.XForwardedHost); got != "gateway.example.com" {
+		t.Errorf("Expected X-Forwarded-Host gateway.example.com got %v", got)
+	}
+}
+
+func TestRewriterTrustedChain(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8, 192.0.2.1")
+	req := httptest.NewRequest("GET", "http://gateway/api/users", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	// The client claims to be 6.6.6.6, but the first untrusted hop seen by
+	// the proxies is 198.51.100.9.
+	req.Header.Add(moria.XForwardedFor, "6.6.6.6, 198.51.100.9")
+	req.Header.Add(moria.XForwardedFor, "192.0.2.1")
+	req.Header.Set(moria.XForwardedProto, "https")
+	req.Header.Set(moria.XForwardedHost, "api.example.com")
+
+	if got := rw.ClientIP(req); got != "198.51.100.9" {
+		t.Errorf("Expected client 198.51.100.9 got %v", got)
+	}
+	rw.Rewrite(req)
+	if got := req.Header.Get(moria.XForwardedFor); got != "198.51.100.9, 192.0.2.1, 10.0.0.2" {
+		t.Errorf("Expected chain from the client got %v", got)
+	}
+	if got := req.Header.Get(moria.XForwardedProto); got != "https" {
+		t.Errorf("Expected trusted X-Forwarded-Proto https got %v", got)
+	}
+	if got := req.Header.Get(moria.XForwardedHost); got != "api.example.com" {
+		t.Errorf("Expected trusted X-Forwarded-Host api.example.com got %v", got)
+	}
+}
+
+func TestRewriterAllProxiesTrusted(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	req := httptest.NewRequest("GET", "http://gateway/api/users", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set(moria.XForwardedFor, "10.1.1.1")
+	if got := rw.ClientIP(req); got != "10.1.1.1" {
+		t.Errorf("Expected the furthest hop 10.1.1.1 got %v", got)
+	}
+}
+
+func TestMuxIgnoresSpoofedForwardedFor(t *testing.T) {
+	os.Unsetenv("TRUSTED_PROXIES")
+	_, backend, gateway := newGateway(t, "GET", "/xff", echoHeader(moria.XForwardedFor))
+	defer backend.Close()
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/api/xff", nil)
+	req.Header.Set(moria.XForwardedFor, "1.2.3.4")
+	if status, body := do(t, req); status != 200 || body != "127.0.0.1" {
+		t.Errorf("Expected 200 127.0.0.1 got %d %v", status, body)
+	}
+}
+
+func TestRewriterForwardedStandard(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	rw.Forwarded, rw.ForwardedBy = moria.ForwardedStandard, "_gw"
+	req := httptest.NewRequest("GET", "http://gateway.example.com/api/users", nil)
+	req.RemoteAddr = "[2001:db8::7]:5000"
+	req.Header.Set(moria.Forwarded, "for=1.2.3.4")
+	req.Header.Set(moria.XForwardedFor, "1.2.3.4")
+	rw.Rewrite(req)
+
+	if got := req.Header.Get(moria.Forwarded); got != `for="[2001:db8::7]";by=_gw;proto=http;host=gateway.example.com` {
+		t.Errorf("Unexpected Forwarded header %v", got)
+	}
+	if got := req.Header.Get(moria.XForwardedFor); got != "" {
+		t.Errorf("Expected no X-Forwarded-For in standard mode got %v", got)
+	}
+}
+
+func TestRewriterForwardedTrustedChain(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	rw.Forwarded, rw.ForwardedBy = moria.ForwardedBoth, "_gw"
+	req := httptest.NewRequest("GET", "http://gateway/api/users", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set(moria.Forwarded, `for=6.6.6.6, For="198.51.100.9:4711";proto=https;host=api.example.com, for=10.0.0.5;by="[2001:db8::1]"`)
+	req.Header.Set(moria.XForwardedFor, "7.7.7.7")
+
+	if got := rw.ClientIP(req); got != "198.51.100.9" {
+		t.Errorf("Expected client 198.51.100.9 got %v", got)
+	}
+	rw.Rewrite(req)
+	want := `for="198.51.100.9:4711";proto=https;host=api.example.com, for=10.0.0.5;by="[2001:db8::1]", for=10.0.0.2;by=_gw;proto=http;host=gateway`
+	if got := req.Header.Get(moria.Forwarded); got != want {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+	if got := req.Header.Get(moria.XForwardedFor); got != "198.51.100.9, 10.0.0.5, 10.0.0.2" {
+		t.Errorf("Expected X-Forwarded-For from the same chain got %v", got)
+	}
+}
+
+func TestRewriterForwardedObfuscatedAndMalformed(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	rw.Forwarded = moria.ForwardedStandard
+	req := httptest.NewRequest("GET", "http://gateway/api/users", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set(moria.Forwarded, "for=_client7, for=10.0.0.5")
+	if got := rw.ClientIP(req); got != "_client7" {
+		t.Errorf("Expected obfuscated client _client7 got %v", got)
+	}
+	req.Header.Set(moria.Forwarded, `for=1.1.1.1, for="10.0.0.5`)
+	if got := rw.ClientIP(req); got != "unknown" {
+		t.Errorf("Expected a malformed element to end the chain got %v", got)
+	}
+}
+
+func TestForwardedHeadersMode(t *testing.T) {
+	defer os.Unsetenv("FORWARDED_HEADERS")
+	for value, want := range map[string]moria.ForwardedMode{
+		"":         moria.ForwardedLegacy,
+		"standard": moria.ForwardedStandard,
+		"BOTH":     moria.ForwardedBoth,
+		"rfc7239":  moria.ForwardedLegacy,
+	} {
+		os.Setenv("FORWARDED_HEADERS", value)
+		if got := moria.ForwardedHeaders(); got != want {
+			t.Errorf("FORWARDED_HEADERS=%q: expected %v got %v", value, want, got)
+		}
+	}
+}
+
+func TestMuxSendsForwarded(t *testing.T) {
+	os.Setenv("FORWARDED_HEADERS", "standard")
+	_, backend, gateway := newGateway(t, "GET", "/forwarded", echoHeader(moria.Forwarded))
+	os.Unsetenv("FORWARDED_HEADERS")
+	defer backend.Close()
+	defer gateway.Close()
+
+	host := strings.TrimPrefix(gateway.URL, "http://")
+	// The host has a port, so it is quoted.
+	want := `for=127.0.0.1;by=127.0.0.1;proto=http;host="` + host + `"`
+	if status, body := get(t, gateway.URL+"/api/forwarded"); status != 200 || body != want {
+		t.Errorf("Expected 200 %v got %d %v", want, status, body)
+	}
+}
+
+func TestRewriterConnectionCannotDropForwardingHeaders(t *testing.T) {
+	rw := trustedRewriter(t, "10.0.0.0/8")
+	rw.Forwarded, rw.ForwardedBy, rw.Hostname = moria.ForwardedBoth, "_gw", "gw-1"
+	req := httptest.NewRequest("GET", "http://gateway.example.com/api/users", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set(moria.Connection, "X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host, Forwarded, X-Forwarded-Server, X-Secret")
+	req.Header.Set("X-Secret", "hop")
+	rw.Rewrite(req)
+
+	for name, want := range map[string]string{
+		moria.XForwardedFor:    "203.0.113.7",
+		moria.XForwardedProto:  "http",
+		moria.XForwardedHost:   "gateway.example.com",
+		moria.XForwardedServer: "gw-1",
+		moria.Forwarded:        "for=203.0.113.7;by=_gw;proto=http;host=gateway.example.com",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("Expected %v: %v got %q", name, want, got)
+		}
+	}
+	if got := req.Header.Get("X-Secret"); got != "" {
+		t.Errorf("Expected headers listed in Connection to be removed got X-Secret: %v", got)
+	}
+	if got := req.Header.Get(moria.Connection); got != "" {
+		t.Errorf("Expected Connection to be removed got %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package moria
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes returned by the gateway itself, from
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	grpcInternal         = 13
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// isGRPC reports whether a request or response carries a gRPC message, such
+// as application/grpc or application/grpc+proto.
+func isGRPC(h http.Header) bool {
+	contentType := h.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// grpcTransport returns the transport gRPC requests to an upstream use.
+// gRPC needs HTTP/2 end to end: HTTPS upstreams negotiate it, plain ones are
+// spoken to over h2c.
+func (mux *Mux) grpcTransport(up *upstream) http.RoundTripper {
+	if up.scheme == "https" {
+		return up.transport
+	}
+	if _, ok := up.transport.(*http.Transport); ok {
+		return mux.h2cTransport
+	}
+	return up.transport
+}
+
+// grpcStatus maps an error the gateway hit while proxying a gRPC call to the
+// status code the client library expects.
+func grpcStatus(err error) int {
+	if e, ok := err.(*StatusError); ok {
+		switch e.Code {
+		case http.StatusUnauthorized:
+			return grpcUnauthenticated
+		case http.StatusForbidden:
+			return grpcPermissionDenied
+		case http.StatusNotFound:
+			return grpcUnimplemented
+		case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+			return grpcDeadlineExceeded
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			return grpcUnavailable
+		}
+		return grpcInternal
+	}
+	if e, ok := err.(net.Error); ok {
+		if e.Timeout() {
+			return grpcDeadlineExceeded
+		}
+		return grpcUnavailable
+	}
+	if err == io.EOF {
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only response: gRPC
+// clients read the outcome from grpc-status, not the HTTP status code.
+func writeGRPCError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatus(err)))
+	w.Header().Set("Grpc-Message", grpcMessage(err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcMessage percent-encodes a message as the gRPC spec requires for the
+// grpc-message header.
+func grpcMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
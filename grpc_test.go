@@ -0,0 +1,143 @@
+package moria_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame wraps message in the length-prefixed framing gRPC uses on the
+// wire.
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// grpcCall makes a unary gRPC call through the gateway over h2c.
+func grpcCall(t *testing.T, url, message string) *http.Response {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(grpcFrame(message)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+	response, err := h2cClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// newGRPCGateway registers a gRPC echo service with a gateway that accepts
+// h2c.  The backend only answers HTTP/2 requests that accept trailers, like
+// real gRPC servers.
+func newGRPCGateway(t *testing.T) (*moria.Mux, *httptest.Server, *httptest.Server) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" || r.URL.Path != "/echo.Echo/Say" {
+			http.Error(w, "not a gRPC call: "+r.Proto+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}), &http2.Server{}))
+	record := &moria.ServiceRecord{ID: "echo-1", Name: "echo", Address: strings.TrimPrefix(backend.URL, "http://")}
+	record.GenerateRecord([]moria.EtcdRoute{{Path: "/echo.Echo/Say", GRPC: true}})
+	mux := moria.NewMux()
+	register(mux, record)
+	return mux, backend, httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+}
+
+func TestGRPCProxy(t *testing.T) {
+	_, backend, gateway := newGRPCGateway(t)
+	defer backend.Close()
+	defer gateway.Close()
+
+	response := grpcCall(t, gateway.URL+"/echo.Echo/Say", "hello")
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !bytes.Equal(body, grpcFrame("hello")) {
+		t.Fatalf("Expected echoed frame got %d %q", response.StatusCode, body)
+	}
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected grpc-status 0 in trailers got %q", status)
+	}
+	if message := response.Trailer.Get("Grpc-Message"); message != "ok" {
+		t.Errorf("Expected grpc-message ok in trailers got %q", message)
+	}
+}
+
+func TestGRPCUnknownMethod(t *testing.T) {
+	_, backend, gateway := newGRPCGateway(t)
+	defer backend.Close()
+	defer gateway.Close()
+
+	response := grpcCall(t, gateway.URL+"/echo.Echo/Shout", "hello")
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Grpc-Status") != "12" {
+		t.Errorf("Expected grpc-status 12 got %d %q", response.StatusCode, response.Header.Get("Grpc-Status"))
+	}
+}
+
+func TestGRPCBackendUnavailable(t *testing.T) {
+	_, backend, gateway := newGRPCGateway(t)
+	defer gateway.Close()
+	backend.Close()
+
+	response := grpcCall(t, gateway.URL+"/echo.Echo/Say", "hello")
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Grpc-Status") != "14" {
+		t.Errorf("Expected grpc-status 14 got %d %q", response.StatusCode, response.Header.Get("Grpc-Status"))
+	}
+	if response.Header.Get("Grpc-Message") == "" {
+		t.Error("Expected a grpc-message describing the failure")
+	}
+}
+
+func TestGRPCPackageStartingWithAPI(t *testing.T) {
+	paths := make(chan string, 10)
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+	record := &moria.ServiceRecord{ID: "orders-1", Name: "orders", Address: strings.TrimPrefix(backend.URL, "http://")}
+	record.GenerateRecord([]moria.EtcdRoute{
+		{Path: "/api.v1.Orders/Get", GRPC: true, IP: &moria.IPPolicy{Allow: []string{"10.8.0.0/16"}}},
+		{Path: "/api.v1.Orders/List", GRPC: true},
+	})
+	mux := moria.NewMux()
+	register(mux, record)
+	gateway := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	defer gateway.Close()
+
+	response := grpcCall(t, gateway.URL+"/api.v1.Orders/Get", "hello")
+	response.Body.Close()
+	if status := response.Header.Get("Grpc-Status"); status == "" || status == "0" {
+		t.Errorf("Expected the method's IP policy to refuse the call got grpc-status %q", status)
+	}
+	response = grpcCall(t, gateway.URL+"/api.v1.Orders/List", "hello")
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	select {
+	case path := <-paths:
+		if path != "/api.v1.Orders/List" {
+			t.Errorf("Expected the method path to reach the backend unchanged got %q", path)
+		}
+	default:
+		t.Error("Expected the call to reach the backend")
+	}
+}
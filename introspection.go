@@ -0,0 +1,218 @@
+package moria
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// XAuthSubject carries the subject of an introspected token to backends.
+	XAuthSubject = "X-Auth-Subject"
+	// XAuthScopes carries the space separated scopes of an introspected token.
+	XAuthScopes = "X-Auth-Scopes"
+
+	// defaultIntrospectionCacheTTL is how long results without an expiry,
+	// including every inactive token, are cached.
+	defaultIntrospectionCacheTTL = time.Minute
+	// maxIntrospectionCache bounds the number of cached tokens.
+	maxIntrospectionCache = 10000
+	introspectionTimeout  = 5 * time.Second
+)
+
+// IntrospectionPolicy declares that a route needs an opaque OAuth2 access
+// token, checked with the authorization server's RFC 7662 introspection
+// endpoint, e.g.
+//
+//	{"method": "POST", "path": "/orders", "introspect": {"scopes": ["orders:write"]}}
+//
+// Routes declaring a jwt policy as well verify tokens as JWTs.
+type IntrospectionPolicy struct {
+	Scopes []string `json:"scopes,omitempty"` // Every one of these must be granted to the token.
+}
+
+// Introspector asks an authorization server whether access tokens are
+// active, caching the answers until the tokens expire.
+type Introspector struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	CacheTTL     time.Duration // How long to cache results without an expiry.
+	Client       *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*introspection
+}
+
+// introspection is the part of an introspection response the gateway uses.
+type introspection struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Subject  string `json:"sub"`
+	Expiry   int64  `json:"exp"`
+
+	expires time.Time
+}
+
+// NewIntrospector returns an introspector calling endpoint, authenticating
+// with the client credentials when clientID is set.
+func NewIntrospector(endpoint, clientID, clientSecret string) *Introspector {
+	return &Introspector{
+		Endpoint:     endpoint,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		CacheTTL:     defaultIntrospectionCacheTTL,
+		Client:       &http.Client{Timeout: introspectionTimeout},
+		cache:        make(map[[sha256.Size]byte]*introspection),
+	}
+}
+
+// IntrospectorFromEnv configures an introspector from INTROSPECTION_URL,
+// INTROSPECTION_CLIENT_ID, INTROSPECTION_CLIENT_SECRET and
+// INTROSPECTION_CACHE_TTL.  It returns nil if no endpoint is set.
+func IntrospectorFromEnv() *Introspector {
+	endpoint := os.Getenv("INTROSPECTION_URL")
+	if endpoint == "" {
+		return nil
+	}
+	introspector := NewIntrospector(endpoint, os.Getenv("INTROSPECTION_CLIENT_ID"), os.Getenv("INTROSPECTION_CLIENT_SECRET"))
+	if d, err := time.ParseDuration(os.Getenv("INTROSPECTION_CACHE_TTL")); err == nil && d > 0 {
+		introspector.CacheTTL = d
+	}
+	return introspector
+}
+
+// introspect returns what the authorization server knows about token.
+func (i *Introspector) introspect(token string) (*introspection, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	i.mu.Lock()
+	result, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && now.Before(result.expires) {
+		return result, nil
+	}
+
+	result, err := i.request(token)
+	if err != nil {
+		return nil, err
+	}
+	result.expires = now.Add(i.CacheTTL)
+	if result.Active && result.Expiry != 0 {
+		result.expires = time.Unix(result.Expiry, 0)
+		if !now.Before(result.expires) {
+			result = &introspection{expires: now.Add(i.CacheTTL)}
+		}
+	}
+	i.store(key, result, now)
+	return result, nil
+}
+
+func (i *Introspector) request(token string) (*introspection, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest("POST", i.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if i.ClientID != "" {
+		request.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+	}
+	response, err := i.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %v", response.Status)
+	}
+	result := &introspection{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// store caches a result, dropping expired entries once the cache is full.
+func (i *Introspector) store(key [sha256.Size]byte, result *introspection, now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.cache) >= maxIntrospectionCache {
+		for k, cached := range i.cache {
+			if !now.Before(cached.expires) {
+				delete(i.cache, k)
+			}
+		}
+		if len(i.cache) >= maxIntrospectionCache {
+			i.cache = make(map[[sha256.Size]byte]*introspection)
+		}
+	}
+	i.cache[key] = result
+}
+
+// checkIntrospection authenticates a request carrying an opaque bearer token.
+func (mux *Mux) checkIntrospection(request *http.Request, policy *IntrospectionPolicy) (*Principal, error) {
+	if mux.introspector == nil {
+		mux.ctx.log.Errorf("No introspection endpoint configured for %v", request.URL.Path)
+		return nil, &StatusError{Code: http.StatusInternalServerError, Message: "token introspection is not configured"}
+	}
+	token := bearerToken(request)
+	if token == "" {
+		return nil, bearerError("", "missing bearer token")
+	}
+	result, err := mux.introspector.introspect(token)
+	if err != nil {
+		mux.ctx.log.Errorf("Token introspection failed: %v", err)
+		return nil, &StatusError{Code: http.StatusServiceUnavailable, Message: "unable to verify access token"}
+	}
+	if !result.Active {
+		return nil, bearerError("invalid_token", "token is not active")
+	}
+	scopes := strings.Fields(result.Scope)
+	if missing := missingScopes(scopes, policy.Scopes); len(missing) > 0 {
+		return nil, &StatusError{
+			Code:    http.StatusForbidden,
+			Message: "token lacks scope " + strings.Join(missing, " "),
+			Header: http.Header{"Www-Authenticate": {
+				`Bearer realm="moria", error="insufficient_scope", scope="` + strings.Join(policy.Scopes, " ") + `"`,
+			}},
+		}
+	}
+	principal := &Principal{Subject: result.Subject, Scheme: "oauth2", Headers: make(http.Header)}
+	if principal.Subject == "" {
+		principal.Subject = result.Username
+	}
+	if principal.Subject == "" {
+		principal.Subject = result.ClientID
+	}
+	principal.Headers.Set(XAuthSubject, principal.Subject)
+	principal.Headers.Set(XAuthScopes, strings.Join(scopes, " "))
+	return principal, nil
+}
+
+// missingScopes returns the required scopes not among granted.
+func missingScopes(granted, required []string) []string {
+	var missing []string
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,110 @@
+package moria_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// newIntrospectionServer answers RFC 7662 requests from tokens, counting the
+// calls it receives.  Unknown tokens are inactive.
+func newIntrospectionServer(tokens map[string]map[string]interface{}, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if id, secret, _ := r.BasicAuth(); id != "gateway" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+// newIntrospectionGateway serves GET and POST /api/orders, the latter needing
+// the orders:write scope, from a backend echoing the identity it receives.
+func newIntrospectionGateway(t *testing.T, endpoint string) *moria.Mux {
+	t.Setenv("INTROSPECTION_URL", endpoint)
+	t.Setenv("INTROSPECTION_CLIENT_ID", "gateway")
+	t.Setenv("INTROSPECTION_CLIENT_SECRET", "s3cret")
+	return newRoutedMux(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/orders", Introspect: &moria.IntrospectionPolicy{}},
+		{Method: "POST", Path: "/orders", Introspect: &moria.IntrospectionPolicy{Scopes: []string{"orders:write"}}},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(moria.XAuthSubject) + "|" + r.Header.Get(moria.XAuthScopes)))
+	}))
+}
+
+func callWithToken(mux *moria.Mux, method, token string, header http.Header) (int, string, http.Header) {
+	recorder := serve(mux, method, "http://gateway/api/orders", nil, bearer(token, header))
+	return recorder.Code, recorder.Body.String(), recorder.Header()
+}
+
+func TestIntrospectionActiveToken(t *testing.T) {
+	var calls int32
+	server := newIntrospectionServer(map[string]map[string]interface{}{
+		"opaque-1": {"active": true, "sub": "user-7", "scope": "orders:read orders:write", "exp": time.Now().Add(time.Hour).Unix()},
+	}, &calls)
+	defer server.Close()
+	mux := newIntrospectionGateway(t, server.URL)
+
+	for i := 0; i < 3; i++ {
+		status, body, _ := callWithToken(mux, "GET", "opaque-1", http.Header{"X-Auth-Subject": {"admin"}})
+		if status != http.StatusOK || body != "user-7|orders:read orders:write" {
+			t.Fatalf("Expected 200 with the subject and scopes got %d %v", status, body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the result to be cached got %d introspection calls", calls)
+	}
+}
+
+func TestIntrospectionRejected(t *testing.T) {
+	var calls int32
+	server := newIntrospectionServer(map[string]map[string]interface{}{
+		"reader":  {"active": true, "client_id": "batch", "scope": "orders:read", "exp": time.Now().Add(time.Hour).Unix()},
+		"expired": {"active": true, "sub": "user-7", "exp": time.Now().Add(-time.Minute).Unix()},
+	}, &calls)
+	defer server.Close()
+	mux := newIntrospectionGateway(t, server.URL)
+
+	if status, _, header := callWithToken(mux, "GET", "", nil); status != http.StatusUnauthorized || header.Get("Www-Authenticate") == "" {
+		t.Errorf("Expected a 401 challenge without a token got %d %v", status, header)
+	}
+	for _, token := range []string{"revoked", "expired"} {
+		if status, _, _ := callWithToken(mux, "GET", token, nil); status != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %v got %d", token, status)
+		}
+	}
+	if status, body, _ := callWithToken(mux, "GET", "reader", nil); status != http.StatusOK || body != "batch|orders:read" {
+		t.Errorf("Expected the client to be the subject got %d %v", status, body)
+	}
+	status, _, header := callWithToken(mux, "POST", "reader", nil)
+	if status != http.StatusForbidden || header.Get("Www-Authenticate") != `Bearer realm="moria", error="insufficient_scope", scope="orders:write"` {
+		t.Errorf("Expected 403 insufficient_scope got %d %v", status, header)
+	}
+
+	before := atomic.LoadInt32(&calls)
+	callWithToken(mux, "GET", "revoked", nil)
+	if after := atomic.LoadInt32(&calls); after != before {
+		t.Errorf("Expected inactive tokens to be cached got %d more calls", after-before)
+	}
+}
+
+func TestIntrospectionUnavailable(t *testing.T) {
+	var calls int32
+	server := newIntrospectionServer(nil, &calls)
+	mux := newIntrospectionGateway(t, server.URL)
+	server.Close()
+
+	if status, _, _ := callWithToken(mux, "GET", "opaque-1", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when the endpoint is down got %d", status)
+	}
+}
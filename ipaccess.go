@@ -0,0 +1,90 @@
+package moria
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IPPolicy restricts the client addresses a service or route accepts, e.g.
+//
+//	{"ip": {"allow": ["10.8.0.0/16"], "deny": ["10.8.13.0/24"]}}
+//
+// Deny is checked first.  A non-empty Allow list refuses every address it
+// does not hold.  A service's policy applies to all its routes, and a route's
+// policy is checked in addition.  Entries that cannot be parsed make the
+// policy refuse every request, so a typo never opens a route up.
+type IPPolicy struct {
+	Allow []string `json:"allow,omitempty"` // Networks or addresses allowed in.
+	Deny  []string `json:"deny,omitempty"`  // Networks or addresses refused.
+
+	once  sync.Once
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	err   error
+}
+
+// parse parses the lists once.
+func (policy *IPPolicy) parse() error {
+	policy.once.Do(func() {
+		if policy.allow, policy.err = ParseCIDRs(strings.Join(policy.Allow, ",")); policy.err != nil {
+			return
+		}
+		policy.deny, policy.err = ParseCIDRs(strings.Join(policy.Deny, ","))
+	})
+	return policy.err
+}
+
+// allows reports whether a client address may reach what the policy guards.
+func (policy *IPPolicy) allows(ip net.IP) (bool, error) {
+	if err := policy.parse(); err != nil {
+		return false, err
+	}
+	if ip == nil {
+		return len(policy.allow) == 0 && len(policy.deny) == 0, nil
+	}
+	if containsIP(policy.deny, ip) {
+		return false, nil
+	}
+	return len(policy.allow) == 0 || containsIP(policy.allow, ip), nil
+}
+
+// checkIP refuses requests from clients the service or route policies do not
+// let in.
+func (mux *Mux) checkIP(request *http.Request, handler *PatternHandler) error {
+	var policies []*IPPolicy
+	if config := mux.serviceConfig(handler.Service); config != nil && config.IP != nil {
+		policies = append(policies, config.IP)
+	}
+	if handler.Route != nil && handler.Route.IP != nil {
+		policies = append(policies, handler.Route.IP)
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(mux.clientIP(request))
+	for _, policy := range policies {
+		allowed, err := policy.allows(ip)
+		if err != nil {
+			mux.ctx.log.Errorf("Invalid IP policy for %v: %v", handler.Service, err)
+		}
+		if !allowed {
+			return &StatusError{Code: http.StatusForbidden, Message: "client address is not allowed"}
+		}
+	}
+	return nil
+}
+
+// clientIP returns the address of the client that made a request, looking
+// past trusted proxies when the mux rewrites forwarded headers.
+func (mux *Mux) clientIP(request *http.Request) string {
+	if rw, ok := mux.rewriter.(*HeaderRewriter); ok {
+		return rw.ClientIP(request)
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package moria_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+// fromAddress sends a GET through mux as if it came from remoteAddr.
+func fromAddress(mux *moria.Mux, path, remoteAddr string, header http.Header) int {
+	request := httptest.NewRequest("GET", "http://gateway"+path, nil)
+	request.RemoteAddr = remoteAddr
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestIPRoutePolicy(t *testing.T) {
+	vpn := &moria.IPPolicy{Allow: []string{"10.8.0.0/16"}, Deny: []string{"10.8.13.0/24"}}
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/admin/users", IP: vpn},
+		{Method: "GET", Path: "/users"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	cases := []struct {
+		path, addr string
+		status     int
+	}{
+		{"/api/admin/users", "10.8.4.2:5000", http.StatusOK},
+		{"/api/admin/users", "10.8.13.7:5000", http.StatusForbidden},
+		{"/api/admin/users", "203.0.113.9:5000", http.StatusForbidden},
+		{"/api/users", "203.0.113.9:5000", http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := fromAddress(mux, c.path, c.addr, nil); status != c.status {
+			t.Errorf("%v from %v: expected %d got %d", c.path, c.addr, c.status, status)
+		}
+	}
+}
+
+func TestIPPolicyUsesClientIP(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/admin", IP: &moria.IPPolicy{Allow: []string{"10.8.0.0/16"}}},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	viaProxy := http.Header{"X-Forwarded-For": {"10.8.4.2"}}
+	if status := fromAddress(mux, "/api/admin", "192.0.2.10:443", viaProxy); status != http.StatusOK {
+		t.Errorf("Expected the client behind a trusted proxy to be allowed got %d", status)
+	}
+	if status := fromAddress(mux, "/api/admin", "203.0.113.9:443", viaProxy); status != http.StatusForbidden {
+		t.Errorf("Expected a forged X-Forwarded-For to be ignored got %d", status)
+	}
+}
+
+func TestIPPolicyInvalidEntryDenies(t *testing.T) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{
+		{Method: "GET", Path: "/admin", IP: &moria.IPPolicy{Deny: []string{"10.0.0.0/33"}}},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	if status := fromAddress(mux, "/api/admin", "203.0.113.9:443", nil); status != http.StatusForbidden {
+		t.Errorf("Expected an unparseable policy to refuse requests got %d", status)
+	}
+}
+
+func TestIPServicePolicyReloaded(t *testing.T) {
+	os.Setenv("VINE_ENV", "test")
+	os.Setenv("NAMESPACE", "services")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/services/billing/test/routes", `[{"method":"GET","path":"/invoices"}]`, nil)
+	keys.Set(context.TODO(), "/services/billing/test/hosts/billing-1", backend.Listener.Addr().String(), nil)
+	keys.Set(context.TODO(), "/services/billing/test/config", `{"ip":{"allow":["10.8.0.0/16"]}}`, nil)
+	mux := moria.NewMux()
+	exchange := moria.NewExchange("services", keys, mux)
+	if err := exchange.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go exchange.Watch()
+
+	if status := fromAddress(mux, "/api/invoices", "203.0.113.9:443", nil); status != http.StatusForbidden {
+		t.Fatalf("Expected the service policy to refuse outside addresses got %d", status)
+	}
+	keys.Set(context.TODO(), "/services/billing/test/config", `{"ip":{"allow":["10.8.0.0/16","203.0.113.0/24"]}}`, nil)
+	eventually(t, func() bool {
+		return fromAddress(mux, "/api/invoices", "203.0.113.9:443", nil) == http.StatusOK
+	})
+}
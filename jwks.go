@@ -0,0 +1,266 @@
+package moria
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// defaultJWKSReloadInterval is how often a JWKS file is checked for changes.
+const defaultJWKSReloadInterval = 30 * time.Second
+
+// JWKS holds the keys JWTs are verified with.  Keys are loaded from JSON Web
+// Key Set documents (RFC 7517) in a file, in etcd, or both; each source can be
+// replaced on its own while requests are being verified.
+type JWKS struct {
+	mu      sync.RWMutex
+	sources map[string][]*jwk // Keys by the source they were loaded from.
+
+	path    string    // JWKS file reloaded by Watch.
+	modTime time.Time // Modification time of the file when it was loaded.
+	log     Logger
+}
+
+// jwk is a verification key from a key set.
+type jwk struct {
+	kid string
+	alg string
+	key interface{} // *rsa.PublicKey, *ecdsa.PublicKey or []byte for HMAC.
+}
+
+// NewJWKS returns an empty key set.
+func NewJWKS() *JWKS {
+	return &JWKS{sources: make(map[string][]*jwk)}
+}
+
+// Load replaces the keys from source with those in a JWKS document.
+func (s *JWKS) Load(source string, document []byte) error {
+	keys, err := parseJWKS(document)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[source] = keys
+	return nil
+}
+
+// Remove drops the keys loaded from source.
+func (s *JWKS) Remove(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sources, source)
+}
+
+// LoadFile loads a JWKS file and remembers it so that Watch can reload it.
+func (s *JWKS) LoadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	document, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := s.Load("file:"+path, document); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path, s.modTime = path, info.ModTime()
+	return nil
+}
+
+// Reload re-reads the JWKS file if it has changed since it was last loaded.
+// The current keys are kept if the new file cannot be parsed.
+func (s *JWKS) Reload() error {
+	s.mu.RLock()
+	path, modTime := s.path, s.modTime
+	s.mu.RUnlock()
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+	if err := s.LoadFile(path); err != nil {
+		return err
+	}
+	orDefault(s.log).Infof("Reloaded JWKS from %v", path)
+	return nil
+}
+
+// Watch reloads the JWKS file every interval until stop is closed.
+func (s *JWKS) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				orDefault(s.log).Errorf("Unable to reload JWKS: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Follow keeps the key set in step with a store whose values are JWKS
+// documents, such as one per identity provider.
+func (s *JWKS) Follow(store *Store) {
+	store.OnChange(func(name, value string, deleted bool) {
+		if deleted {
+			s.Remove("etcd:" + name)
+			store.logger().Infof("Removed JWKS %v", name)
+			return
+		}
+		if err := s.Load("etcd:"+name, []byte(value)); err != nil {
+			store.logger().Warningf("Invalid JWKS %v: %v", name, err)
+			return
+		}
+		store.logger().Infof("Loaded JWKS %v", name)
+	})
+}
+
+// keys returns the keys that may have signed a token with the given key ID
+// and algorithm.  A token naming a key ID only matches that key.
+func (s *JWKS) keys(kid, alg string) []*jwk {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []*jwk
+	for _, keys := range s.sources {
+		for _, k := range keys {
+			if kid != "" && k.kid != kid {
+				continue
+			}
+			if k.alg != "" && k.alg != alg {
+				continue
+			}
+			matches = append(matches, k)
+		}
+	}
+	return matches
+}
+
+// JWKSReloadInterval reads JWKS_RELOAD_INTERVAL, the duration between checks
+// of the JWKS file.
+func JWKSReloadInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("JWKS_RELOAD_INTERVAL"))
+	if err != nil || d <= 0 {
+		return defaultJWKSReloadInterval
+	}
+	return d
+}
+
+// ConfigureJWKS loads the key set from the file named by JWKS_PATH and from
+// the documents stored under /gateway/jwks/<env> in etcd, and keeps both up
+// to date.
+func ConfigureJWKS(keys *JWKS, c client.KeysAPI) {
+	if path := os.Getenv("JWKS_PATH"); path != "" {
+		if err := keys.LoadFile(path); err != nil {
+			orDefault(keys.log).Errorf("Unable to load JWKS from %v: %v", path, err)
+		}
+		go keys.Watch(JWKSReloadInterval(), nil)
+	}
+	if c != nil {
+		store := NewStore(GatewayKey("jwks"), c)
+		store.log = keys.log
+		keys.Follow(store)
+		if err := store.Init(); err != nil {
+			store.logger().Errorf("Unable to load JWKS from etcd: %v", err)
+			return
+		}
+		go store.Watch()
+	}
+}
+
+// parseJWKS decodes the RSA, P-256 and symmetric keys of a key set.  Keys
+// meant for encryption are skipped.
+func parseJWKS(document []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(document, &set); err != nil {
+		return nil, err
+	}
+	var keys []*jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		parsed := &jwk{kid: k.Kid, alg: k.Alg}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("key %q: invalid exponent", k.Kid)
+			}
+			parsed.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			if !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("key %q: point is not on P-256", k.Kid)
+			}
+			parsed.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %q: invalid secret", k.Kid)
+			}
+			parsed.key = secret
+		default:
+			continue
+		}
+		keys = append(keys, parsed)
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
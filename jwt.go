@@ -0,0 +1,227 @@
+package moria
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway allows for clock skew between the gateway and token issuers.
+const jwtLeeway = 30 * time.Second
+
+// JWTPolicy declares that a route needs a valid bearer JWT, e.g.
+//
+//	{"method": "GET", "path": "/orders", "jwt": {"issuer": "https://id.example.com/", "audience": ["orders"], "claims": {"sub": "X-User-Id"}}}
+//
+// Issuer and Audience default to the JWT_ISSUER and JWT_AUDIENCE environment
+// variables; when neither is set that check is skipped.
+type JWTPolicy struct {
+	Issuer   string            `json:"issuer,omitempty"`   // Required iss claim.
+	Audience []string          `json:"audience,omitempty"` // The aud claim must contain one of these.
+	Claims   map[string]string `json:"claims,omitempty"`   // Claims forwarded to the backend, mapped to header names.
+}
+
+// JWTDefaults reads JWT_ISSUER and JWT_AUDIENCE, a comma separated list, which
+// apply to routes whose policy does not set them.
+func JWTDefaults() JWTPolicy {
+	return JWTPolicy{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: splitHeaderList([]string{os.Getenv("JWT_AUDIENCE")}),
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(request *http.Request) string {
+	authorization := request.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// checkJWT authenticates a request carrying a bearer JWT.
+func (mux *Mux) checkJWT(request *http.Request, policy *JWTPolicy) (*Principal, error) {
+	token := bearerToken(request)
+	if token == "" {
+		return nil, bearerError("", "missing bearer token")
+	}
+	if policy.Issuer == "" {
+		policy = &JWTPolicy{Issuer: mux.jwtDefaults.Issuer, Audience: policy.Audience, Claims: policy.Claims}
+	}
+	if len(policy.Audience) == 0 {
+		policy = &JWTPolicy{Issuer: policy.Issuer, Audience: mux.jwtDefaults.Audience, Claims: policy.Claims}
+	}
+	claims, err := verifyJWT(token, mux.jwks, policy, time.Now())
+	if err != nil {
+		return nil, bearerError("invalid_token", err.Error())
+	}
+	principal := &Principal{Scheme: "jwt", Headers: make(http.Header)}
+	principal.Subject, _ = claims["sub"].(string)
+	for claim, header := range policy.Claims {
+		if value, ok := claims[claim]; ok {
+			principal.Headers.Set(header, claimString(value))
+		}
+	}
+	return principal, nil
+}
+
+// verifyJWT checks a compact JWT's signature against keys, its expiry, and
+// the issuer and audience required by policy, and returns its claims.
+func verifyJWT(token string, keys *JWKS, policy *JWTPolicy, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if err := verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature, keys); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if policy.Issuer != "" && claims["iss"] != policy.Issuer {
+		return nil, fmt.Errorf("token issuer %v is not accepted", claims["iss"])
+	}
+	if len(policy.Audience) > 0 && !audienceMatches(claims["aud"], policy.Audience) {
+		return nil, errors.New("token audience is not accepted")
+	}
+	return claims, nil
+}
+
+// verifySignature checks signature with every key that could have made it.
+// The key type must fit the algorithm, so a public RSA key can never be used
+// as an HMAC secret.
+func verifySignature(alg, kid, signed string, signature []byte, keys *JWKS) error {
+	if alg != "RS256" && alg != "ES256" && alg != "HS256" {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	digest := sha256.Sum256([]byte(signed))
+	for _, k := range keys.keys(kid, alg) {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg == "ES256" && len(signature) == 64 {
+				r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(key, digest[:], r, s) {
+					return nil
+				}
+			}
+		case []byte:
+			if alg == "HS256" {
+				mac := hmac.New(sha256.New, key)
+				mac.Write([]byte(signed))
+				if hmac.Equal(mac.Sum(nil), signature) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("token signature is invalid")
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericDate reads a JWT time claim, in seconds since the epoch.
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// audienceMatches reports whether the aud claim, a string or an array of
+// strings, contains any accepted audience.
+func audienceMatches(aud interface{}, accepted []string) bool {
+	var audiences []string
+	switch v := aud.(type) {
+	case string:
+		audiences = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	for _, a := range audiences {
+		for _, b := range accepted {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString formats a claim for a header: strings as they are, arrays of
+// strings comma separated and anything else as JSON.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				b, _ := json.Marshal(v)
+				return string(b)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ",")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
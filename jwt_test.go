@@ -0,0 +1,255 @@
+package moria_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+var (
+	testRSAKey, _  = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _   = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testHMACSecret = []byte("a shared secret of at least 32 bytes")
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwksDocument builds a JWKS holding the test keys under the given key IDs.
+func jwksDocument(t *testing.T, rsaKid, ecKid, octKid string) []byte {
+	var keys []map[string]string
+	if rsaKid != "" {
+		keys = append(keys, map[string]string{"kty": "RSA", "kid": rsaKid, "use": "sig",
+			"n": b64(testRSAKey.N.Bytes()), "e": b64(big.NewInt(int64(testRSAKey.E)).Bytes())})
+	}
+	if ecKid != "" {
+		keys = append(keys, map[string]string{"kty": "EC", "kid": ecKid, "crv": "P-256",
+			"x": b64(testECKey.X.FillBytes(make([]byte, 32))), "y": b64(testECKey.Y.FillBytes(make([]byte, 32)))})
+	}
+	if octKid != "" {
+		keys = append(keys, map[string]string{"kty": "oct", "kid": octKid, "alg": "HS256", "k": b64(testHMACSecret)})
+	}
+	document, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+// signJWT makes a compact JWT with the test key for alg.
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, testHMACSecret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + b64(signature)
+}
+
+// validClaims are accepted by jwtPolicy.
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://id.example.com/",
+		"aud":   []string{"billing", "orders"},
+		"sub":   "alice",
+		"roles": []string{"admin", "ops"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+var jwtPolicy = &moria.JWTPolicy{
+	Issuer:   "https://id.example.com/",
+	Audience: []string{"orders"},
+	Claims:   map[string]string{"sub": "X-User-Id", "roles": "X-User-Roles"},
+}
+
+// newJWTGateway routes GET /api/orders, which requires jwtPolicy, to a
+// backend echoing the claim headers.
+func newJWTGateway(t *testing.T) *moria.Mux {
+	return newRoutedMux(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders", JWT: jwtPolicy}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("X-User-Id") + "|" + r.Header.Get("X-User-Roles")))
+		}))
+}
+
+// bearer adds an Authorization header carrying token, if any, to a copy of
+// header.
+func bearer(token string, header http.Header) http.Header {
+	if token == "" {
+		return header
+	}
+	with := http.Header{"Authorization": {"Bearer " + token}}
+	for name, values := range header {
+		with[name] = values
+	}
+	return with
+}
+
+func getWithToken(t *testing.T, mux *moria.Mux, token string, header http.Header) *http.Response {
+	return serve(mux, "GET", "http://gateway/api/orders", nil, bearer(token, header)).Result()
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	mux := newJWTGateway(t)
+	mux.JWKS().Load("test", jwksDocument(t, "rsa", "ec", "oct"))
+
+	for alg, kid := range map[string]string{"RS256": "rsa", "ES256": "ec", "HS256": "oct"} {
+		response := getWithToken(t, mux, signJWT(t, alg, kid, validClaims()), nil)
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || string(body) != "alice|admin,ops" {
+			t.Errorf("%v: expected 200 alice|admin,ops got %d %s", alg, response.StatusCode, body)
+		}
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	mux := newJWTGateway(t)
+	mux.JWKS().Load("test", jwksDocument(t, "rsa", "", ""))
+
+	claims := func(name string, value interface{}) map[string]interface{} {
+		c := validClaims()
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	// An HMAC made with the RSA public key as the secret must not pass as
+	// a signature from that key.
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+	payload, _ := json.Marshal(validClaims())
+	mac := hmac.New(sha256.New, testRSAKey.N.Bytes())
+	mac.Write([]byte(b64(header) + "." + b64(payload)))
+	confused := b64(header) + "." + b64(payload) + "." + b64(mac.Sum(nil))
+	unsigned := b64([]byte(`{"alg":"none"}`)) + "." + b64(payload) + "."
+
+	cases := map[string]string{
+		"expired":        signJWT(t, "RS256", "rsa", claims("exp", time.Now().Add(-time.Hour).Unix())),
+		"no expiry":      signJWT(t, "RS256", "rsa", claims("exp", nil)),
+		"not yet valid":  signJWT(t, "RS256", "rsa", claims("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong issuer":   signJWT(t, "RS256", "rsa", claims("iss", "https://evil.example.com/")),
+		"wrong audience": signJWT(t, "RS256", "rsa", claims("aud", "billing")),
+		"unknown key":    signJWT(t, "ES256", "ec", validClaims()),
+		"alg confusion":  confused,
+		"alg none":       unsigned,
+		"malformed":      "not.a.jwt",
+	}
+	for name, token := range cases {
+		response := getWithToken(t, mux, token, nil)
+		challenge := response.Header.Get("Www-Authenticate")
+		if response.StatusCode != http.StatusUnauthorized || challenge == "" {
+			t.Errorf("%v: expected 401 with a challenge got %d %q", name, response.StatusCode, challenge)
+		}
+	}
+
+	response := getWithToken(t, mux, "", nil)
+	if response.StatusCode != http.StatusUnauthorized || response.Header.Get("Www-Authenticate") != `Bearer realm="moria"` {
+		t.Errorf("Expected 401 with a bare challenge got %d %q", response.StatusCode, response.Header.Get("Www-Authenticate"))
+	}
+}
+
+func TestJWTClaimHeadersCannotBeSpoofed(t *testing.T) {
+	mux := newJWTGateway(t)
+	mux.JWKS().Load("test", jwksDocument(t, "rsa", "", ""))
+
+	claims := validClaims()
+	delete(claims, "roles")
+	response := getWithToken(t, mux, signJWT(t, "RS256", "rsa", claims), http.Header{"X-User-Roles": {"admin"}, "X-User-Id": {"mallory"}})
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "alice|" {
+		t.Errorf("Expected client claim headers to be dropped got %s", body)
+	}
+}
+
+func TestJWKSFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, jwksDocument(t, "rsa", "", ""), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mux := newJWTGateway(t)
+	if err := mux.JWKS().LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, "ES256", "ec", validClaims())
+	if response := getWithToken(t, mux, token, nil); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 before the key is published got %d", response.StatusCode)
+	}
+
+	ioutil.WriteFile(path, jwksDocument(t, "", "ec", ""), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if err := mux.JWKS().Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if response := getWithToken(t, mux, token, nil); response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 after reload got %d", response.StatusCode)
+	}
+}
+
+func TestJWKSFollowsEtcd(t *testing.T) {
+	t.Setenv("VINE_ENV", "test")
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/gateway/jwks/test/idp", string(jwksDocument(t, "rsa", "", "")), nil)
+	mux := newJWTGateway(t)
+	store := moria.NewStore(moria.GatewayKey("jwks"), keys)
+	mux.JWKS().Follow(store)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go store.Watch()
+
+	rsaToken, ecToken := signJWT(t, "RS256", "rsa", validClaims()), signJWT(t, "ES256", "ec", validClaims())
+	if response := getWithToken(t, mux, rsaToken, nil); response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 with a key from etcd got %d", response.StatusCode)
+	}
+	keys.Set(context.TODO(), "/gateway/jwks/test/partner", string(jwksDocument(t, "", "ec", "")), nil)
+	eventually(t, func() bool { return getWithToken(t, mux, ecToken, nil).StatusCode == http.StatusOK })
+	keys.Delete(context.TODO(), "/gateway/jwks/test/idp", nil)
+	eventually(t, func() bool { return getWithToken(t, mux, rsaToken, nil).StatusCode == http.StatusUnauthorized })
+}
+
+func TestJWTRouteFromEtcdJSON(t *testing.T) {
+	var routes []moria.EtcdRoute
+	js := `[{"method":"GET","path":"/orders","jwt":{"issuer":"https://id.example.com/","audience":["orders"],"claims":{"sub":"X-User-Id"}}}]`
+	if err := json.Unmarshal([]byte(js), &routes); err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].JWT == nil || routes[0].JWT.Issuer != "https://id.example.com/" || routes[0].JWT.Claims["sub"] != "X-User-Id" {
+		t.Errorf("Unexpected policy %+v", routes[0].JWT)
+	}
+}
@@ -1,28 +1,166 @@
 package moria
 
 import (
-	"log"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-// Listen starts the api gateway
+// Listen starts the api gateway.  Requests are written to an access log only
+// when ACCESS_LOG is set, see AccessLogFromEnv.
 func Listen(e *Exchange) {
+	accessLog, accessLogFile, err := AccessLogFromEnv()
+	if err != nil {
+		e.mux.ctx.log.Errorf("Unable to open the access log: %v", err)
+		return
+	}
+	if accessLog != nil {
+		accessLog.log = e.mux.ctx.log
+	}
+	if accessLogFile != nil {
+		accessLogFile.log = e.mux.ctx.log
+		stop := make(chan struct{})
+		defer accessLogFile.Close()
+		defer close(stop)
+		accessLogFile.ReopenOnSIGHUP(stop)
+	}
 	// Listen for HTTP requests from API clients and forward them to the
 	// appropriate service backend.
+	handler := accessLog.Handler(e.mux)
+	plainHandler := handler
+	if H2C() {
+		plainHandler = h2c.NewHandler(handler, &http2.Server{})
+	}
 	port := os.Getenv("PORT")
-	log.Printf("Listening for HTTP requests on port %v", port)
-	err := http.ListenAndServe(":"+port, Log(e.mux))
+	keyPair, err := ServerKeyPair()
+	if err != nil {
+		e.mux.ctx.log.Errorf("%v", err)
+		return
+	}
+	clientCAs, err := ClientCAs()
+	if err != nil {
+		e.mux.ctx.log.Errorf("%v", err)
+		return
+	}
+	trusted, err := ProxyProtocolCIDRs()
 	if err != nil {
-		log.Print(err)
+		e.mux.ctx.log.Errorf("Invalid PROXY_PROTOCOL_CIDRS: %v", err)
+		return
+	}
+	if adminPort := AdminPort(); adminPort != "" {
+		admin := http.NewServeMux()
+		admin.Handle(MetricsPath, e.mux.MetricsHandler())
+		go func() {
+			e.mux.ctx.log.Infof("Serving metrics on port %v", adminPort)
+			if err := serve(":"+adminPort, admin, nil, e.mux.ctx.log); err != nil {
+				e.mux.ctx.log.Errorf("Unable to serve metrics: %v", err)
+			}
+		}()
+	}
+	tlsPort := os.Getenv("TLS_PORT")
+	if keyPair == nil && tlsPort == "" {
+		e.mux.ctx.log.Infof("Listening for HTTP requests on port %v", port)
+		err := serve(":"+port, plainHandler, trusted, e.mux.ctx.log)
+		if err != nil {
+			e.mux.ctx.log.Errorf("%v", err)
+		}
+		return
+	}
+
+	// HTTPS is served on TLS_PORT, alongside plain HTTP on PORT, or on PORT
+	// alone when TLS_PORT is not set.  Certificates stored in etcd are
+	// picked by SNI, with the configured key pair as the default.
+	certs := NewCertStore(keyPair)
+	if keyPair != nil {
+		keyPair.log = e.mux.ctx.log
+		go keyPair.Watch(CertReloadInterval(), nil)
+	}
+	if e.client != nil {
+		store := NewStore(GatewayKey("certificates"), e.client)
+		store.log = e.mux.ctx.log
+		certs.Follow(store)
+		if err := store.Init(); err != nil {
+			e.mux.ctx.log.Errorf("Unable to load TLS certificates from etcd: %v", err)
+		} else {
+			go store.Watch()
+		}
+	}
+	if tlsPort == "" {
+		tlsPort, port = port, ""
+	}
+	errc := make(chan error, 2)
+	if port != "" {
+		go func() {
+			e.mux.ctx.log.Infof("Listening for HTTP requests on port %v", port)
+			errc <- serve(":"+port, plainHandler, trusted, e.mux.ctx.log)
+		}()
+	}
+	config := ServerTLSConfig(certs.GetCertificate)
+	if clientCAs != nil {
+		RequestClientCerts(config, clientCAs)
 	}
+	go func() {
+		e.mux.ctx.log.Infof("Listening for HTTPS requests on port %v", tlsPort)
+		errc <- serveTLS(":"+tlsPort, handler, config, trusted, e.mux.ctx.log)
+	}()
+	e.mux.ctx.log.Errorf("%v", <-errc)
 }
 
-// Log logs api gateway requests
-func Log(handler http.Handler) http.Handler {
-	wrapper := func(writer http.ResponseWriter, request *http.Request) {
-		log.Printf("%s %s %s", request.RemoteAddr, request.Method, request.URL.Path)
-		handler.ServeHTTP(writer, request)
+// H2C reports whether the plaintext listener also accepts HTTP/2 without TLS,
+// as set by the H2C environment variable.
+func H2C() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("H2C"))
+	return enabled
+}
+
+// listen opens a TCP listener on addr.  Peers in trusted may prefix their
+// connections with a PROXY protocol header carrying the real client address;
+// invalid headers are logged to log.
+func listen(addr string, trusted []*net.IPNet, log Logger) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(trusted) > 0 {
+		ln = &proxyListener{Listener: ln, trusted: trusted, log: log}
+	}
+	return ln, nil
+}
+
+// serve accepts plain HTTP connections on addr.
+func serve(addr string, handler http.Handler, trusted []*net.IPNet, log Logger) error {
+	ln, err := listen(addr, trusted, log)
+	if err != nil {
+		return err
 	}
-	return http.HandlerFunc(wrapper)
+	return http.Serve(ln, handler)
+}
+
+// serveTLS accepts TLS connections on addr and serves handler with the given
+// configuration, negotiating HTTP/2 through ALPN.
+func serveTLS(addr string, handler http.Handler, config *tls.Config, trusted []*net.IPNet, log Logger) error {
+	ln, err := listen(addr, trusted, log)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return err
+	}
+	return server.ServeTLS(ln, "", "")
+}
+
+// Log logs api gateway requests to stderr in Combined Log Format, once their
+// responses are written.
+//
+// Deprecated: Use an AccessLog, such as the one configured by
+// AccessLogFromEnv, which Listen installs.
+func Log(handler http.Handler) http.Handler {
+	accessLog, _ := NewAccessLog(os.Stderr, CombinedLogFormat)
+	return accessLog.Handler(handler)
 }
@@ -0,0 +1,82 @@
+package moria_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/http2"
+)
+
+// freePort returns a TCP port that is currently free on localhost.
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// h2cClient speaks HTTP/2 without TLS.
+var h2cClient = &http.Client{Transport: &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+}}
+
+func TestListenHTTP2(t *testing.T) {
+	mux, backend, plain := newGateway(t, "GET", "/proto", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	plain.Close()
+	defer backend.Close()
+
+	port, tlsPort := freePort(t), freePort(t)
+	env := map[string]string{
+		"PORT":          port,
+		"TLS_PORT":      tlsPort,
+		"TLS_CERT_PATH": "superfake.com.cert",
+		"TLS_KEY_PATH":  "superfake.com.key",
+		"H2C":           "true",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	go moria.Listen(moria.NewExchange("services", nil, mux))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	var res *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res, err = client.Get("https://127.0.0.1:" + tlsPort + "/api/proto"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 over TLS got %v", res.Proto)
+	}
+
+	res, err = h2cClient.Get("http://127.0.0.1:" + port + "/api/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.ProtoMajor != 2 || res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 over h2c got %v %v", res.StatusCode, res.Proto)
+	}
+}
@@ -0,0 +1,247 @@
+package moria
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// LogFormat is how a StructuredLogger writes entries.
+type LogFormat int
+
+const (
+	// LogfmtFormat writes key=value pairs, e.g.
+	//	time=2006-01-02T15:04:05.000Z level=info msg="proxied request" service=orders status=200
+	LogfmtFormat LogFormat = iota
+	// JSONFormat writes one object per line.
+	JSONFormat
+)
+
+// Fields are the key/value pairs attached to log entries, such as route,
+// service, backend, status, duration and request_id.
+type Fields map[string]interface{}
+
+// FieldLogger is a Logger whose entries carry fields.  Loggers that do not
+// implement it get the fields appended to their messages instead.
+type FieldLogger interface {
+	Logger
+	WithFields(fields Fields) Logger
+}
+
+// StructuredLogger writes leveled entries, one per line, as logfmt or JSON.
+type StructuredLogger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  LogLevel
+	format LogFormat
+	fields Fields
+}
+
+// NewStructuredLogger returns a logger writing entries at lvl and above to w.
+func NewStructuredLogger(w io.Writer, lvl LogLevel, format LogFormat) *StructuredLogger {
+	return &StructuredLogger{mu: &sync.Mutex{}, out: w, level: lvl, format: format}
+}
+
+// LoggerFromEnv returns a logger writing to stderr as set by LOG_FORMAT, json
+// or logfmt (the default), and LOG_LEVEL, info (the default), warn or error.
+func LoggerFromEnv() *StructuredLogger {
+	format := LogfmtFormat
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		format = JSONFormat
+	}
+	var lvl LogLevel = INFO
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "warn", "warning":
+		lvl = WARN
+	case "error":
+		lvl = ERROR
+	}
+	return NewStructuredLogger(os.Stderr, lvl, format)
+}
+
+// WithFields returns a logger adding fields to every entry.
+func (l *StructuredLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &StructuredLogger{mu: l.mu, out: l.out, level: l.level, format: l.format, fields: merged}
+}
+
+func (l *StructuredLogger) Infof(format string, args ...interface{}) {
+	l.write(INFO, fmt.Sprintf(format, args...))
+}
+
+func (l *StructuredLogger) Warningf(format string, args ...interface{}) {
+	l.write(WARN, fmt.Sprintf(format, args...))
+}
+
+func (l *StructuredLogger) Errorf(format string, args ...interface{}) {
+	l.write(ERROR, fmt.Sprintf(format, args...))
+}
+
+var levelNames = map[LogLevel]string{INFO: "info", WARN: "warn", ERROR: "error"}
+
+func (l *StructuredLogger) write(lvl LogLevel, msg string) {
+	if lvl < l.level {
+		return
+	}
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	var b bytes.Buffer
+	if l.format == JSONFormat {
+		entry := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			entry[k] = jsonValue(v)
+		}
+		entry["time"], entry["level"], entry["msg"] = now, levelNames[lvl], msg
+		if err := json.NewEncoder(&b).Encode(entry); err != nil {
+			return
+		}
+	} else {
+		b.WriteString("time=" + now + " level=" + levelNames[lvl] + " msg=" + logfmtValue(msg))
+		for _, k := range sortedKeys(l.fields) {
+			b.WriteString(" " + k + "=" + logfmtValue(fmt.Sprint(l.fields[k])))
+		}
+		b.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(b.Bytes())
+}
+
+// jsonValue keeps values JSON can represent and formats the rest, such as
+// durations and errors, as strings.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int64, float64:
+		return v
+	case time.Duration:
+		return v.Seconds()
+	}
+	return fmt.Sprint(v)
+}
+
+// logfmtValue quotes values that would otherwise break a logfmt line.
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withFields returns l with fields attached to its entries.
+func withFields(l Logger, fields Fields) Logger {
+	if fl, ok := l.(FieldLogger); ok {
+		return fl.WithFields(fields)
+	}
+	return &suffixLogger{Logger: l, suffix: formatFields(fields)}
+}
+
+// suffixLogger appends fields to the messages of loggers that cannot carry
+// them.
+type suffixLogger struct {
+	Logger
+	suffix string
+}
+
+func (s *suffixLogger) Infof(format string, args ...interface{}) {
+	s.Logger.Infof("%s %s", fmt.Sprintf(format, args...), s.suffix)
+}
+
+func (s *suffixLogger) Warningf(format string, args ...interface{}) {
+	s.Logger.Warningf("%s %s", fmt.Sprintf(format, args...), s.suffix)
+}
+
+func (s *suffixLogger) Errorf(format string, args ...interface{}) {
+	s.Logger.Errorf("%s %s", fmt.Sprintf(format, args...), s.suffix)
+}
+
+func formatFields(fields Fields) string {
+	pairs := make([]string, 0, len(fields))
+	for _, k := range sortedKeys(fields) {
+		pairs = append(pairs, k+"="+logfmtValue(fmt.Sprint(fields[k])))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// defaultLogger is where muxes log until SetLogger is called, and where the
+// exported helpers log when used without a mux.
+var defaultLogger Logger = LoggerFromEnv()
+
+// orDefault returns l, or defaultLogger for parts of the gateway used
+// without a mux.
+func orDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+// switchLogger is the logger of a mux.  The parts of the gateway wired to the
+// mux hold it rather than the logger it forwards to, so that SetLogger
+// reaches them too, even while they run.
+type switchLogger struct {
+	v atomic.Value // Holds a loggerBox.
+}
+
+// loggerBox lets loggers of different types be stored in an atomic.Value.
+type loggerBox struct {
+	Logger
+}
+
+func newSwitchLogger(l Logger) *switchLogger {
+	s := &switchLogger{}
+	s.set(l)
+	return s
+}
+
+func (s *switchLogger) set(l Logger) {
+	s.v.Store(loggerBox{l})
+}
+
+func (s *switchLogger) get() Logger {
+	return s.v.Load().(loggerBox).Logger
+}
+
+func (s *switchLogger) Infof(format string, args ...interface{}) {
+	s.get().Infof(format, args...)
+}
+
+func (s *switchLogger) Warningf(format string, args ...interface{}) {
+	s.get().Warningf(format, args...)
+}
+
+func (s *switchLogger) Errorf(format string, args ...interface{}) {
+	s.get().Errorf(format, args...)
+}
+
+// WithFields attaches fields to the entries of the current logger.
+func (s *switchLogger) WithFields(fields Fields) Logger {
+	return withFields(s.get(), fields)
+}
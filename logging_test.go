@@ -0,0 +1,106 @@
+package moria_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+func TestStructuredLoggerLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l := moria.NewStructuredLogger(&buf, moria.INFO, moria.LogfmtFormat)
+	l.WithFields(moria.Fields{"service": "orders", "route": "GET /orders/:id"}).Infof("Proxied %v", "GET /api/orders/1")
+	line := buf.String()
+	for _, part := range []string{" level=info ", ` msg="Proxied GET /api/orders/1" `, ` route="GET /orders/:id" service=orders`} {
+		if !strings.Contains(line, part) {
+			t.Errorf("Expected %q in %q", part, line)
+		}
+	}
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, "\n") {
+		t.Errorf("Expected one entry starting with the time got %q", line)
+	}
+}
+
+func TestStructuredLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := moria.NewStructuredLogger(&buf, moria.INFO, moria.JSONFormat)
+	l.WithFields(moria.Fields{"status": 502, "duration": 1500 * time.Millisecond}).Errorf("Error forwarding")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON entry got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{"level": "error", "msg": "Error forwarding", "status": 502.0, "duration": 1.5}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("Expected %v: %v got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestStructuredLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := moria.NewStructuredLogger(&buf, moria.WARN, moria.LogfmtFormat)
+	l.Infof("dropped")
+	l.WithFields(moria.Fields{"service": "orders"}).Infof("dropped")
+	l.Warningf("kept")
+	if got := buf.String(); strings.Contains(got, "dropped") || !strings.Contains(got, "msg=kept") {
+		t.Errorf("Expected only warnings to be written got %q", got)
+	}
+}
+
+func TestMuxLogsRequestFields(t *testing.T) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders/:id"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer gateway.Close()
+	var buf bytes.Buffer
+	mux.SetLogger(moria.NewStructuredLogger(&buf, moria.INFO, moria.JSONFormat))
+
+	request := httptest.NewRequest("GET", "http://gateway/api/orders/1", nil)
+	request.Header.Set("X-Request-Id", "req-42")
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	var proxied map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON entries got %q: %v", line, err)
+		}
+		if msg, _ := entry["msg"].(string); strings.HasPrefix(msg, "Proxied") {
+			proxied = entry
+		}
+	}
+	if proxied == nil {
+		t.Fatalf("Expected the request to be logged got %q", buf.String())
+	}
+	expected := map[string]interface{}{"request_id": "req-42", "service": "test-service", "route": "GET /orders/:id", "status": 200.0, "method": "GET"}
+	for k, v := range expected {
+		if proxied[k] != v {
+			t.Errorf("Expected %v: %v got %v", k, v, proxied[k])
+		}
+	}
+	if _, ok := proxied["duration"].(float64); !ok {
+		t.Errorf("Expected the duration in seconds got %v", proxied["duration"])
+	}
+}
+
+func TestMuxLoggerReachesWiredParts(t *testing.T) {
+	os.Setenv("VINE_ENV", "test")
+	keys := newFakeKeys()
+	storeAPIKey(keys, "acme-secret", "acme", "*")
+	mux := moria.NewMux()
+	followAPIKeys(t, keys, mux)
+
+	// The key store was wired up before the logger was set.
+	logs := &syncBuffer{}
+	mux.SetLogger(moria.NewStructuredLogger(logs, moria.INFO, moria.LogfmtFormat))
+	storeAPIKey(keys, "globex-secret", "globex", "*")
+	eventually(t, func() bool { return strings.Contains(logs.String(), "for globex") })
+}
@@ -0,0 +1,256 @@
+package moria
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// MetricsPath is where the admin port serves metrics.
+const MetricsPath = "/metrics"
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricMethods get their own label value.  Other methods are counted as
+// OTHER so that clients cannot add series by making methods up.
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodOptions: true, http.MethodConnect: true, http.MethodTrace: true,
+}
+
+// unmatchedRoute labels requests that matched no route.
+const unmatchedRoute = "unmatched"
+
+// requestLabels identify a request series.  Routes are labelled by their
+// template, never by the path requested, to keep the number of series
+// bounded.
+type requestLabels struct {
+	route, method, class, service string
+}
+
+type backendLabels struct {
+	service, backend string
+}
+
+type histogram struct {
+	buckets []uint64 // Counts per bucket, not cumulative.
+	sum     float64
+	count   uint64
+}
+
+// metrics counts the traffic through a mux.
+type metrics struct {
+	mu             sync.Mutex
+	requests       map[requestLabels]*histogram
+	upstreamErrors map[backendLabels]uint64
+	inFlight       atomic.Int64
+	watchLag       atomic.Uint64 // Etcd indexes the last watch event trailed the cluster by.
+	lastWatched    atomic.Int64  // When the etcd watch last delivered a change, in Unix nanoseconds.
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests:       make(map[requestLabels]*histogram),
+		upstreamErrors: make(map[backendLabels]uint64),
+	}
+	m.lastWatched.Store(time.Now().UnixNano())
+	return m
+}
+
+// observe records a finished request.  handler is nil for requests that
+// matched no route.
+func (m *metrics) observe(handler *PatternHandler, method string, status int, elapsed time.Duration) {
+	labels := requestLabels{route: unmatchedRoute, method: method, class: statusClass(status)}
+	if handler != nil {
+		labels.route, labels.service = handler.name(), handler.Service
+	}
+	if !metricMethods[method] {
+		labels.method = "OTHER"
+	}
+	seconds := elapsed.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.requests[labels] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// upstreamError records a request that could not be forwarded to a backend.
+func (m *metrics) upstreamError(service, backend string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstreamErrors[backendLabels{service, backend}]++
+}
+
+// watched records a change delivered by the etcd watch.  The response's Index
+// is the cluster's X-Etcd-Index when it was sent and the node's
+// ModifiedIndex the index the change was applied at, so their difference is
+// how many changes the cluster had moved on by.
+func (m *metrics) watched(response *client.Response) {
+	m.lastWatched.Store(time.Now().UnixNano())
+	node := response.Node
+	if node == nil {
+		node = response.PrevNode
+	}
+	if node == nil {
+		return
+	}
+	var lag uint64
+	if response.Index > node.ModifiedIndex {
+		lag = response.Index - node.ModifiedIndex
+	}
+	m.watchLag.Store(lag)
+}
+
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// AdminPort returns the port metrics are served on, as set by ADMIN_PORT.
+// Metrics are not served when it is empty.
+func AdminPort() string {
+	return os.Getenv("ADMIN_PORT")
+}
+
+// MetricsHandler serves the mux's metrics in the Prometheus text format.
+func (mux *Mux) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writer.Write(mux.metricsText())
+	})
+}
+
+func (mux *Mux) metricsText() []byte {
+	var b bytes.Buffer
+	m := mux.metrics
+
+	m.mu.Lock()
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].less(requests[j]) })
+
+	writeMetricHeader(&b, "moria_requests_total", "counter", "Requests served, by route template, method, status class and service.")
+	for _, labels := range requests {
+		fmt.Fprintf(&b, "moria_requests_total{%s} %d\n", labels.String(), m.requests[labels].count)
+	}
+	writeMetricHeader(&b, "moria_request_duration_seconds", "histogram", "Time taken to serve requests, by route template, method, status class and service.")
+	for _, labels := range requests {
+		h := m.requests[labels]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(&b, "moria_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels.String(), bound, cumulative)
+		}
+		fmt.Fprintf(&b, "moria_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels.String(), h.count)
+		fmt.Fprintf(&b, "moria_request_duration_seconds_sum{%s} %g\n", labels.String(), h.sum)
+		fmt.Fprintf(&b, "moria_request_duration_seconds_count{%s} %d\n", labels.String(), h.count)
+	}
+
+	backends := make([]backendLabels, 0, len(m.upstreamErrors))
+	for labels := range m.upstreamErrors {
+		backends = append(backends, labels)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].service != backends[j].service {
+			return backends[i].service < backends[j].service
+		}
+		return backends[i].backend < backends[j].backend
+	})
+	writeMetricHeader(&b, "moria_upstream_errors_total", "counter", "Requests that could not be forwarded, by service and backend.")
+	for _, labels := range backends {
+		fmt.Fprintf(&b, "moria_upstream_errors_total{service=\"%s\",backend=\"%s\"} %d\n",
+			escapeLabel(labels.service), escapeLabel(labels.backend), m.upstreamErrors[labels])
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "moria_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(&b, "moria_requests_in_flight %d\n", m.inFlight.Load())
+
+	active := mux.activeBackends()
+	services := make([]string, 0, len(active))
+	for service := range active {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	writeMetricHeader(&b, "moria_backends", "gauge", "Backends registered, by service.")
+	for _, service := range services {
+		fmt.Fprintf(&b, "moria_backends{service=\"%s\"} %d\n", escapeLabel(service), active[service])
+	}
+
+	writeMetricHeader(&b, "moria_etcd_watch_lag", "gauge", "Etcd indexes the last watched change trailed the cluster by.")
+	fmt.Fprintf(&b, "moria_etcd_watch_lag %d\n", m.watchLag.Load())
+	idle := time.Since(time.Unix(0, m.lastWatched.Load())).Seconds()
+	writeMetricHeader(&b, "moria_etcd_watch_idle_seconds", "gauge", "Seconds since the etcd watch last delivered a change, or since the gateway started.")
+	fmt.Fprintf(&b, "moria_etcd_watch_idle_seconds %g\n", idle)
+	return b.Bytes()
+}
+
+// activeBackends counts the distinct backend addresses of each service.
+func (mux *Mux) activeBackends() map[string]int {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	addresses := make(map[string]map[string]bool)
+	for _, handlers := range mux.routes {
+		for _, handler := range handlers {
+			if addresses[handler.Service] == nil {
+				addresses[handler.Service] = make(map[string]bool)
+			}
+			for _, address := range handler.Addresses {
+				addresses[handler.Service][address] = true
+			}
+		}
+	}
+	counts := make(map[string]int, len(addresses))
+	for service, set := range addresses {
+		counts[service] = len(set)
+	}
+	return counts
+}
+
+func (labels requestLabels) String() string {
+	return fmt.Sprintf("route=\"%s\",method=\"%s\",status=\"%s\",service=\"%s\"",
+		escapeLabel(labels.route), labels.method, labels.class, escapeLabel(labels.service))
+}
+
+func (labels requestLabels) less(other requestLabels) bool {
+	return labels.String() < other.String()
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,96 @@
+package moria_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// scrape returns the metrics exposed by mux.
+func scrape(t *testing.T, mux *moria.Mux) string {
+	recorder := httptest.NewRecorder()
+	mux.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", moria.MetricsPath, nil))
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format got %v", ct)
+	}
+	return recorder.Body.String()
+}
+
+func TestMetricsByRouteTemplate(t *testing.T) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders/:id"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/api/orders/1"}, {"GET", "/api/orders/2"}, {"GET", "/api/missing"}, {"BREW", "/api/coffee"},
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, "http://gateway"+request.path, nil))
+	}
+	metrics := scrape(t, mux)
+	route := `route="GET /orders/:id",method="GET",status="2xx",service="test-service"`
+	for _, line := range []string{
+		`moria_requests_total{` + route + `} 2`,
+		`moria_request_duration_seconds_bucket{` + route + `,le="+Inf"} 2`,
+		`moria_request_duration_seconds_count{` + route + `} 2`,
+		`moria_requests_total{route="unmatched",method="GET",status="4xx",service=""} 1`,
+		`moria_requests_total{route="unmatched",method="OTHER",status="4xx",service=""} 1`,
+		`moria_requests_in_flight 0`,
+		`moria_backends{service="test-service"} 1`,
+		`moria_etcd_watch_lag 0`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Expected %q in\n%v", line, metrics)
+		}
+	}
+	if !regexp.MustCompile(`\nmoria_etcd_watch_idle_seconds [0-9.e-]+\n`).MatchString(metrics) {
+		t.Errorf("Expected the time since the last watch event in\n%v", metrics)
+	}
+	if strings.Contains(metrics, "/api/orders/1") || strings.Contains(metrics, "coffee") {
+		t.Errorf("Expected requested paths to stay out of the labels got\n%v", metrics)
+	}
+}
+
+func TestMetricsUpstreamErrors(t *testing.T) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer gateway.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "http://gateway/api/orders", nil))
+	metrics := scrape(t, mux)
+	expected := `moria_upstream_errors_total{service="test-service",backend="` + address + `"} 1`
+	if !strings.Contains(metrics, expected+"\n") {
+		t.Errorf("Expected %q in\n%v", expected, metrics)
+	}
+	if !strings.Contains(metrics, `moria_requests_total{route="GET /orders",method="GET",status="5xx",service="test-service"} 1`) {
+		t.Errorf("Expected the failed request to be counted as a 5xx (got %d) in\n%v", recorder.Code, metrics)
+	}
+}
+
+func TestMetricsWatchLag(t *testing.T) {
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/services/orders/test/routes", "[]", nil)
+	mux := moria.NewMux()
+	exchange := moria.NewExchange("services", keys, mux)
+	if err := exchange.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go exchange.Watch()
+
+	// The cluster has moved on by 5 indexes by the time the change is
+	// delivered.
+	keys.mu.Lock()
+	keys.index += 5
+	keys.notify(&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/services/orders/test/notes", Value: "x", ModifiedIndex: keys.index - 5}, Index: keys.index})
+	keys.mu.Unlock()
+	eventually(t, func() bool { return strings.Contains(scrape(t, mux), "\nmoria_etcd_watch_lag 5\n") })
+}
@@ -8,10 +8,8 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,7 +26,9 @@ type conflict struct {
 // handle a URL pattern.
 type PatternHandler struct {
 	Pattern   string
-	Addresses []string `json:"addresses"`
+	Addresses []string   `json:"addresses"`
+	Route     *EtcdRoute `json:"route,omitempty"`   // Definition the pattern was registered with.
+	Service   string     `json:"service,omitempty"` // Name of the service exposing the pattern.
 }
 
 // OXY UTILS COMPAT TESTING
@@ -42,7 +42,8 @@ const (
 	ProxyAuthenticate  = "Proxy-Authenticate"
 	ProxyAuthorization = "Proxy-Authorization"
 	Te                 = "Te" // canonicalized version of "TE"
-	Trailers           = "Trailers"
+	Trailer            = "Trailer"
+	Trailers           = "Trailers" // Deprecated: the header is named Trailer.
 	TransferEncoding   = "Transfer-Encoding"
 	Upgrade            = "Upgrade"
 	ContentLength      = "Content-Length"
@@ -62,8 +63,14 @@ type StdHandler struct {
 }
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if isGRPC(req.Header) {
+		writeGRPCError(w, err)
+		return
+	}
 	statusCode := http.StatusInternalServerError
-	if e, ok := err.(net.Error); ok {
+	if e, ok := err.(*StatusError); ok {
+		statusCode = e.Code
+	} else if e, ok := err.(net.Error); ok {
 		if e.Timeout() {
 			statusCode = http.StatusGatewayTimeout
 		} else {
@@ -72,11 +79,26 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 	} else if err == io.EOF {
 		statusCode = http.StatusBadGateway
 	}
+	if e, ok := err.(*StatusError); ok {
+		CopyHeaders(w.Header(), e.Header)
+	}
 	w.WriteHeader(statusCode)
 	js := "{\"error\":\"" + http.StatusText(statusCode) + "\"}"
 	w.Write([]byte(js))
 }
 
+// StatusError is returned by checks the gateway makes before proxying a
+// request; Code is the HTTP status the client should see.
+type StatusError struct {
+	Code    int
+	Message string
+	Header  http.Header // Headers sent with the error, such as an auth challenge.
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
 type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
 
 // ServeHTTP calls f(w, r).
@@ -147,6 +169,11 @@ func (*NOPLogger) Warningf(format string, args ...interface{}) {
 func (*NOPLogger) Errorf(format string, args ...interface{}) {
 }
 
+// WithFields returns the NOPLogger itself.
+func (n *NOPLogger) WithFields(Fields) Logger {
+	return n
+}
+
 func (*NOPLogger) Info(string) {
 
 }
@@ -169,8 +196,8 @@ var HopHeaders = []string{
 	KeepAlive,
 	ProxyAuthenticate,
 	ProxyAuthorization,
-	Te, // canonicalized version of "TE"
-	Trailers,
+	Te,      // canonicalized version of "TE"
+	Trailer, // not Trailers, see https://www.rfc-editor.org/errata/eid4522
 	TransferEncoding,
 	Upgrade,
 }
@@ -183,32 +210,83 @@ var HopHeaders = []string{
 // backend.  Pattern matching logic is based on pat.go.
 // ** FROM https://github.com/jkakar/switchboard
 type Mux struct {
-	rw           sync.RWMutex                 // Synchronize access to routes map.
-	routes       map[string][]*PatternHandler // Patterns mapped to backend services.
-	roundTripper http.RoundTripper
-	ctx          handlerContext
-	rewriter     ReqRewriter
+	rw            sync.RWMutex                 // Synchronize access to routes map.
+	routes        map[string][]*PatternHandler // Patterns mapped to backend services.
+	roundTripper  http.RoundTripper
+	h2cTransport  http.RoundTripper            // Carries gRPC calls to plain HTTP backends.
+	upstreams     map[string]*upstream         // How to reach each backend address.
+	transports    map[string]*serviceTransport // Transports built from service upstream configs.
+	ctx           handlerContext
+	rewriter      ReqRewriter
+	bufferPool    BufferPool                // Buffers used to stream response bodies.
+	flushInterval time.Duration             // How often streamed responses are flushed.
+	dump          DumpConfig                // Opt-in debug dumping of proxied traffic.
+	jwks          *JWKS                     // Keys bearer JWTs are verified with.
+	jwtDefaults   JWTPolicy                 // Issuer and audience for routes that do not set them.
+	apiKeys       *APIKeys                  // Partner API keys accepted on routes that allow them.
+	secrets       *Secrets                  // Shared secrets request signatures are verified with.
+	assertions    *AssertionSigner          // Signs identity assertions for backends; nil when not configured.
+	introspector  *Introspector             // Checks opaque access tokens; nil when not configured.
+	configs       map[string]*ServiceConfig // Service configs, by service name.
+	metrics       *metrics                  // Traffic counters exposed to Prometheus.
+	tracer        *Tracer                   // Exports spans; nil when not configured.
+	logs          *switchLogger             // The logger set with SetLogger, shared by everything the mux wires up.
+
+	tunnelsMu          sync.Mutex                      // Synchronize access to tunnels map.
+	tunnels            map[string]map[*tunnel]struct{} // Upgraded connections by backend address.
+	upgradeIdleTimeout time.Duration                   // Idle time before a tunnel is closed.
 }
 type ReqRewriter interface {
 	Rewrite(r *http.Request)
 }
 
+// HeaderRewriter sets the X-Forwarded-* headers, the Forwarded header, or
+// both on requests to backends.  Incoming forwarding headers are only kept
+// when the request comes from one of TrustedProxies, or from anywhere if
+// TrustForwardHeader is set.
 type HeaderRewriter struct {
 	TrustForwardHeader bool
+	TrustedProxies     []*net.IPNet
 	Hostname           string
+	Forwarded          ForwardedMode // Which forwarding headers to send; legacy when empty.
+	ForwardedBy        string        // by= in Forwarded, e.g. an obfuscated _gateway; the local address when empty.
 }
 
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if rw.TrustForwardHeader {
-			if prior, ok := req.Header[XForwardedFor]; ok {
-				clientIP = strings.Join(prior, ", ") + ", " + clientIP
-			}
-		}
-		req.Header.Set(XForwardedFor, clientIP)
+	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
+	// connection, regardless of what the client sent to us.  This comes first so that a client cannot list the
+	// forwarding headers set below in Connection to have them dropped.
+	RemoveConnectionHeaders(req.Header)
+	RemoveHeaders(req.Header, HopHeaders...)
+
+	trusted := rw.trustsPeer(req)
+	hops := rw.forwardedHops(req)
+	if rw.Forwarded.standard() {
+		rewriteForwarded(req, hops)
+	} else if !trusted {
+		req.Header.Del(Forwarded)
+	}
+	if !rw.Forwarded.legacy() {
+		RemoveHeaders(req.Header, XForwardedFor, XForwardedProto, XForwardedHost)
+	} else {
+		rw.rewriteLegacy(req, hops, trusted)
 	}
 
-	if xfp := req.Header.Get(XForwardedProto); xfp != "" && rw.TrustForwardHeader {
+	if rw.Hostname != "" {
+		req.Header.Set(XForwardedServer, rw.Hostname)
+	}
+}
+
+// rewriteLegacy sets the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers.
+func (rw *HeaderRewriter) rewriteLegacy(req *http.Request, hops []forwardedElement, trusted bool) {
+	if len(hops) > 0 {
+		req.Header.Set(XForwardedFor, strings.Join(forwardedFor(hops), ", "))
+	} else if !trusted {
+		req.Header.Del(XForwardedFor)
+	}
+
+	if xfp := req.Header.Get(XForwardedProto); xfp != "" && trusted {
 		req.Header.Set(XForwardedProto, xfp)
 	} else if req.TLS != nil {
 		req.Header.Set(XForwardedProto, "https")
@@ -216,19 +294,11 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		req.Header.Set(XForwardedProto, "http")
 	}
 
-	if xfh := req.Header.Get(XForwardedHost); xfh != "" && rw.TrustForwardHeader {
+	if xfh := req.Header.Get(XForwardedHost); xfh != "" && trusted {
 		req.Header.Set(XForwardedHost, xfh)
 	} else if req.Host != "" {
 		req.Header.Set(XForwardedHost, req.Host)
 	}
-
-	if rw.Hostname != "" {
-		req.Header.Set(XForwardedServer, rw.Hostname)
-	}
-
-	// Remove hop-by-hop headers to the backend.  Especially important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.
-	RemoveHeaders(req.Header, HopHeaders...)
 }
 
 func RemoveHeaders(headers http.Header, names ...string) {
@@ -237,31 +307,91 @@ func RemoveHeaders(headers http.Header, names ...string) {
 	}
 }
 
+// RemoveConnectionHeaders removes the headers listed in the Connection
+// header, which are hop-by-hop as well (RFC 7230, section 6.1).
+func RemoveConnectionHeaders(headers http.Header) {
+	for _, v := range headers[Connection] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers.Del(name)
+			}
+		}
+	}
+}
+
 // NewMux returns an initialized multiplexor
 func NewMux() *Mux {
-	mux := &Mux{routes: make(map[string][]*PatternHandler), roundTripper: http.DefaultTransport}
+	logs := newSwitchLogger(defaultLogger)
+	mux := &Mux{
+		routes:        make(map[string][]*PatternHandler),
+		roundTripper:  http.DefaultTransport,
+		h2cTransport:  newH2CTransport(),
+		upstreams:     make(map[string]*upstream),
+		transports:    make(map[string]*serviceTransport),
+		bufferPool:    DefaultBufferPool,
+		flushInterval: FlushInterval(),
+		dump:          Dumping(),
+		jwks:          NewJWKS(),
+		jwtDefaults:   JWTDefaults(),
+		apiKeys:       NewAPIKeys(),
+		secrets:       NewSecrets(),
+		introspector:  IntrospectorFromEnv(),
+		configs:       make(map[string]*ServiceConfig),
+		metrics:       newMetrics(),
+		tracer:        tracerFromEnv(logs),
+		logs:          logs,
+		ctx:           handlerContext{log: logs},
+
+		tunnels:            make(map[string]map[*tunnel]struct{}),
+		upgradeIdleTimeout: UpgradeIdleTimeout(),
+	}
 	if mux.rewriter == nil {
 		h, err := os.Hostname()
 		if err != nil {
 			h = "localhost"
 		}
-		mux.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
+		mux.rewriter = &HeaderRewriter{TrustedProxies: trustedProxies(logs), Hostname: h, Forwarded: forwardedHeaders(logs)}
 	}
+	mux.jwks.log, mux.apiKeys.log, mux.secrets.log = logs, logs, logs
 
-	if mux.ctx.log == nil {
-		mux.ctx.log = NullLogger
+	if assertions, err := AssertionSignerFromEnv(); err != nil {
+		logs.Errorf("Unable to load the identity assertion key: %v", err)
+	} else {
+		mux.assertions = assertions
 	}
+
 	if mux.ctx.errHandler == nil {
 		mux.ctx.errHandler = DefaultHandler
 	}
 	return mux
 }
 
+// SetLogger replaces the logger the mux writes to, which by default writes
+// to stderr as set by LOG_FORMAT and LOG_LEVEL.  Everything the mux is wired
+// to, from its key sets to the listeners started by Listen, logs through it
+// as well; it may be called at any time.
+func (mux *Mux) SetLogger(l Logger) {
+	if l == nil {
+		l = NullLogger
+	}
+	mux.logs.set(l)
+}
+
 // Add registers the address of a backend service as a handler for an HTTP
-// method and URL pattern.
+// method and URL pattern.  The route definition is looked up in
+// serviceRecord; AddRoute takes it explicitly.
 func (mux *Mux) Add(method string, pattern string, address string, service string, serviceRecord *ServiceRecord, c client.KeysAPI) {
+	mux.AddRoute(method, pattern, serviceRecord.routeForPattern(method, pattern), address, service, serviceRecord, c)
+}
+
+// AddRoute registers the address of a backend service as a handler for an
+// HTTP method and URL pattern, serving the route defined by route.
+func (mux *Mux) AddRoute(method string, pattern string, route *EtcdRoute, address string, service string, serviceRecord *ServiceRecord, c client.KeysAPI) {
 	mux.rw.Lock()
 	defer mux.rw.Unlock()
+	mux.setUpstream(address, serviceRecord)
+	mux.setServiceConfig(serviceRecord)
+	_, address = splitAddress(address)
 	handlers, present := mux.routes[method]
 	if !present {
 		handlers = make([]*PatternHandler, 0)
@@ -270,38 +400,70 @@ func (mux *Mux) Add(method string, pattern string, address string, service strin
 	// Search for duplicates.
 	for _, handler := range handlers {
 		if pattern == handler.Pattern {
-			handleDuplicates(handler, method, pattern, address, service, serviceRecord, c)
+			if route != nil {
+				handler.Route = route
+			}
+			handler.Service = serviceRecord.Name
+			mux.handleDuplicates(handler, method, pattern, address, service, serviceRecord, c)
 			return
 		}
 	}
 	// Add a new pattern handler for the pattern and address.
-	log.Printf("\n>**************************** New Service Pattern Dicovered ****************************\n>\t%v %v %v\n>\t%v %v\n>\t%v %v\n>\t%v %v\n", pSuccessInline("Registering Route:"), pMethod(method), pattern, pSuccessInline("Machine Name:"), service, "Service Name:", serviceRecord.Name, pSuccessInline("Service Located At:"), address)
+	withFields(mux.ctx.log, Fields{"route": method + " " + pattern, "service": serviceRecord.Name, "instance": service, "backend": address}).Infof("Registered route")
 	addresses := []string{address}
-	handler := PatternHandler{Pattern: pattern, Addresses: addresses}
+	handler := PatternHandler{Pattern: pattern, Addresses: addresses, Route: route, Service: serviceRecord.Name}
 	mux.routes[method] = append(handlers, &handler)
 }
 
-func handleDuplicates(handler *PatternHandler, method string, pattern string, address string, service string, serviceRecord *ServiceRecord, c client.KeysAPI) {
+func (mux *Mux) handleDuplicates(handler *PatternHandler, method string, pattern string, address string, service string, serviceRecord *ServiceRecord, c client.KeysAPI) {
 	for _, existingAddress := range handler.Addresses {
 		if strings.Compare(address, existingAddress) == 0 {
 			return
 		}
 	}
 	// If address doesnt exist for pattern append to handler
-	log.Printf("\n\n\n\n\n\n\n\n>**************************** Additional Machine Discovered ****************************\n>\t%v %v %v\n>\t%v %v\n>\t%v %v\n>\t%v %v\n", pSuccessInline("Registering Route:"), pMethod(method), pattern, pSuccessInline("Machine Name:"), service, "Service Name:", serviceRecord.Name, pSuccessInline("Service Located At:"), address)
+	withFields(mux.ctx.log, Fields{"route": method + " " + pattern, "service": serviceRecord.Name, "instance": service, "backend": address}).Infof("Added backend to route")
 	handler.Addresses = append(handler.Addresses, address)
 	return
 }
 
+// redactURL formats a URL for the logs with secrets masked.
+func (mux *Mux) redactURL(u *url.URL) string {
+	return mux.dump.redactor().URL(u)
+}
+
+// setServiceConfig records the config of a service, which its routes are
+// checked against at request time.  The caller must hold the write lock.
+func (mux *Mux) setServiceConfig(serviceRecord *ServiceRecord) {
+	if serviceRecord.Config != nil {
+		mux.configs[serviceRecord.Name] = serviceRecord.Config
+		return
+	}
+	delete(mux.configs, serviceRecord.Name)
+}
+
+// serviceConfig returns the config of a service, or nil if it has none.
+func (mux *Mux) serviceConfig(service string) *ServiceConfig {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	return mux.configs[service]
+}
+
 // Remove unregisters the address of a backend service as a handler for an
 // HTTP method and URL pattern.
 func (mux *Mux) Remove(method, pattern, address, service string) {
-	pattern = "/api" + pattern
+	mux.remove(method, "/api"+pattern, address, service)
+}
+
+// remove unregisters address from a pattern exactly as it was added.
+func (mux *Mux) remove(method, pattern, address, service string) {
+	_, address = splitAddress(address)
 	mux.rw.Lock()
 	defer mux.rw.Unlock()
+	log := withFields(mux.ctx.log, Fields{"route": method + " " + pattern, "instance": service, "backend": address})
 	handlers, present := mux.routes[method]
 	if !present {
-		log.Printf("\n>\tFAILING Pattern To Be Deleted: %v \n", pattern)
+		log.Warningf("No routes to remove the backend from")
 		return
 	}
 
@@ -310,13 +472,10 @@ func (mux *Mux) Remove(method, pattern, address, service string) {
 		if strings.Compare(pattern, handler.Pattern) == 0 {
 			// Remove the handler if the address to remove is the only one
 			// registered.
-			log.Println("*********************** Unregisterring Service Host ***********************")
-			log.Printf("\n>\t%v %v %v\n", pSuccessInline("Unregistering Route:"), pMethod(method), pattern)
-			log.Printf("\n>\t%v %v\n", pSuccessInline("Service No Longer Located At:"), address)
-			log.Printf("\n>\tPattern To Be Deleted: %v \n>\tPattern Stored: %v\n", pattern, handler.Pattern)
 			if len(handler.Addresses) == 1 && handler.Addresses[0] == address {
-				log.Printf("\n>\t%v %v\n>\tRemoved Handler Entirely", pSuccessInline("Route No Longer Directed To:"), pBold(strings.Title(strings.Replace(service, "-", " ", -1))))
+				log.Infof("Removed route")
 				mux.routes[method] = append(handlers[:i], handlers[i+1:]...)
+				mux.releaseAddress(address)
 				return
 			}
 
@@ -324,92 +483,225 @@ func (mux *Mux) Remove(method, pattern, address, service string) {
 			// handler.
 			for j, existingAddress := range handler.Addresses {
 				if address == existingAddress {
-					log.Printf("\n>\t%v %v\n>\tRemoved Host From Handler Only", pSuccessInline("Route No Longer Directed To:"), pBold(strings.Title(strings.Replace(service, "-", " ", -1))))
-
+					log.Infof("Removed backend from route")
 					handler.Addresses = append(handler.Addresses[:j], handler.Addresses[j+1:]...)
+					mux.releaseAddress(address)
 					return
 				}
 			}
-		} else {
-			log.Printf("\n>\tPATTERN: %v does not match %v", pattern, handler.Pattern)
 		}
 	}
 }
 
+// JWKS returns the key set bearer JWTs are verified with.
+func (mux *Mux) JWKS() *JWKS {
+	return mux.jwks
+}
+
+// APIKeys returns the API keys accepted by the mux.
+func (mux *Mux) APIKeys() *APIKeys {
+	return mux.apiKeys
+}
+
+// Secrets returns the shared secrets request signatures are verified with.
+func (mux *Mux) Secrets() *Secrets {
+	return mux.secrets
+}
+
+// checkRoute enforces the policies declared for the matched route and
+// returns the caller the request was authenticated as, if any.
+func (mux *Mux) checkRoute(request *http.Request, handler *PatternHandler) (*Principal, error) {
+	if err := mux.checkIP(request, handler); err != nil {
+		return nil, err
+	}
+	if handler.Route == nil {
+		return nil, nil
+	}
+	if err := checkClientCert(request, handler.Route.ClientCert); err != nil {
+		return nil, err
+	}
+	if handler.Route.Signature != nil {
+		if err := mux.checkSignature(request, handler.Route.Signature); err != nil {
+			return nil, err
+		}
+	}
+	return mux.authenticate(request, handler)
+}
+
+// releaseAddress forgets address and closes upgraded connections to it once
+// no route directs traffic to it any more.  The caller must hold the write lock.
+func (mux *Mux) releaseAddress(address string) {
+	for _, handlers := range mux.routes {
+		for _, handler := range handlers {
+			for _, existingAddress := range handler.Addresses {
+				if existingAddress == address {
+					return
+				}
+			}
+		}
+	}
+	delete(mux.upstreams, address)
+	mux.closeTunnels(address)
+}
+
 // ServeHTTP dispatches the request to the backend service whose pattern most
 // closely matches the request URL.
 func (mux *Mux) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	mux.serveHTTP(writer, request)
-}
-
-func (mux *Mux) serveHTTP(writer http.ResponseWriter, request *http.Request) {
-	dump, err := httputil.DumpRequest(request, true)
-	if err != nil {
-		http.Error(writer, fmt.Sprint(err), http.StatusInternalServerError)
-		return
+	mux.metrics.inFlight.Add(1)
+	defer mux.metrics.inFlight.Add(-1)
+	sw := &statusWriter{ResponseWriter: writer}
+	start := time.Now()
+	handler := mux.serveHTTP(sw, request)
+	mux.metrics.observe(handler, request.Method, sw.status, time.Since(start))
+}
+
+// serveHTTP proxies a request and returns the handler of the route it
+// matched, or nil when it matched none.
+func (mux *Mux) serveHTTP(writer http.ResponseWriter, request *http.Request) *PatternHandler {
+	log := withFields(mux.ctx.log, Fields{"request_id": requestID(request), "method": request.Method, "path": request.URL.Path})
+	mux.dump.dumpRequest(log, "Received", request)
+	if mux.assertions != nil && request.URL.Path == AssertionJWKSPath {
+		mux.serveAssertionJWKS(writer)
+		return nil
+	}
+	if isPreflight(request) && mux.servePreflight(writer, request) {
+		return nil
 	}
-	log.Printf("Recieved: %q", string(dump))
 	start := time.Now().UTC()
 	// Create address string
 	var address string
 	// Attempt to match the request against registered patterns and addresses.
-	patternErr := findHost(mux, request, writer, &address)
+	handler, patternErr := findHost(mux, request, writer, &address)
 	if patternErr != nil {
-		log.Printf("%v", pDisappointedInline("Invalid URL Pattern"))
-		return
+		log.Infof("No route for %v %v", request.Method, mux.redactURL(request.URL))
+		return nil
+	}
+	log = withFields(log, Fields{"route": handler.name(), "service": handler.Service, "backend": address})
+	entry := accessEntry(request)
+	if entry != nil {
+		entry.RequestID = request.Header.Get(XRequestID)
+		entry.Route, entry.Service, entry.Upstream = handler.name(), handler.Service, address
+	}
+	// Refuse the request if the policies declared for the route are not met.
+	principal, routeErr := mux.checkRoute(request, handler)
+	if routeErr != nil {
+		log.Warningf("Refused %v %v: %v", request.Method, mux.redactURL(request.URL), routeErr)
+		mux.setCORSHeaders(writer.Header(), request, handler)
+		mux.ctx.errHandler.ServeHTTP(writer, request, routeErr)
+		return handler
+	}
+	if entry != nil && principal != nil {
+		entry.User = principal.Subject
 	}
 	// Make new request copy old stuff over
-	reqq := mux.generateInnerRequest(request, request.URL, address)
-	response, roundtripErr := mux.roundTripper.RoundTrip(reqq)
-	// Execute request
-	//response, err := http.DefaultClient.Do(innerRequest)
+	up := mux.upstreamFor(address)
+	reqq := mux.generateInnerRequest(log, request, handler, address, principal)
+	span := mux.startSpan(request, handler, address)
+	span.propagate(reqq)
+	log = withFields(log, Fields{"trace_id": fmt.Sprintf("%x", span.traceID)})
+	transport := up.transport
+	if isGRPC(request.Header) {
+		transport = mux.grpcTransport(up)
+	}
+	upstreamStart := time.Now()
+	response, roundtripErr := transport.RoundTrip(reqq)
+	mux.finishSpan(span, response, roundtripErr)
+	if entry != nil {
+		entry.UpstreamLatency = time.Since(upstreamStart)
+	}
 	if roundtripErr != nil {
-		mux.ctx.log.Errorf("Error forwarding to %v, err: %v\nGenerated Request: %v", request.URL.String(), roundtripErr, reqq.URL.String())
+		mux.metrics.upstreamError(handler.Service, address)
+		withFields(log, Fields{"duration": time.Now().UTC().Sub(start)}).Errorf("Error forwarding %v to %v: %v", mux.redactURL(request.URL), mux.redactURL(reqq.URL), roundtripErr)
 		mux.ctx.errHandler.ServeHTTP(writer, request, roundtripErr)
-		return
+		return handler
 	}
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		mux.handleUpgradeResponse(log, writer, request, response, address)
+		return handler
+	}
+	defer response.Body.Close()
+	fields := Fields{"host": request.Host, "status": response.StatusCode, "duration": time.Now().UTC().Sub(start)}
 	if request.TLS != nil {
-		mux.ctx.log.Infof("HOST: %v,ROUND TRIP: %v, CODE: %v, DURATION: %v TLS:VERSION: %x, TLS:RESUME:%t, TLS:CSUITE:%x, TLS:SERVER:%v",
-			request.Host, request.URL, response.StatusCode, time.Now().UTC().Sub(start),
-			request.TLS.Version,
-			request.TLS.DidResume,
-			request.TLS.CipherSuite,
-			request.TLS.ServerName)
-	} else {
-		log.Printf("HOST: %v,ROUND TRIP: %v, CODE: %v, DURATION: %v", request.Host, request.URL, response.StatusCode, time.Now().UTC().Sub(start))
+		fields["tls_version"] = fmt.Sprintf("%x", request.TLS.Version)
+		fields["tls_resumed"] = request.TLS.DidResume
+		fields["tls_cipher"] = fmt.Sprintf("%x", request.TLS.CipherSuite)
+		fields["tls_server"] = request.TLS.ServerName
+		if cert := verifiedClientCert(request.TLS); cert != nil {
+			fields["tls_client"] = cert.Subject.String()
+		}
 	}
-	// Relay the response from the backend service back to the client.
+	withFields(log, fields).Infof("Proxied %v %v", request.Method, mux.redactURL(request.URL))
+	mux.dump.dumpResponse(log, fmt.Sprintf("Response for %v %v(original[ %v %v])", reqq.Method, mux.redactURL(reqq.URL), request.Method, mux.redactURL(request.URL)), response)
+	// Relay the response from the backend service back to the client.  The
+	// body is streamed so that large downloads never sit in memory.
+	RemoveConnectionHeaders(response.Header)
+	RemoveHeaders(response.Header, HopHeaders...)
+	mux.setCORSHeaders(response.Header, request, handler)
 	CopyHeaders(writer.Header(), response.Header)
-	writer.WriteHeader(response.StatusCode)
-	responseDump, respDumpErr := httputil.DumpResponse(response, true)
-	if respDumpErr != nil {
-		log.Printf("\n>>\tRESPONSE CONTENTS:\n>> for %v %v(original[ %v %v]):\n>>\t %v\n", reqq.Method, reqq.URL, request.Method, request.URL, respDumpErr)
-	} else {
-		log.Printf("\n>>\tRESPONSE CONTENTS:\n>> for %v %v(original[ %v %v]):\n>>\t %v\n", reqq.Method, reqq.URL, request.Method, request.URL, string(responseDump))
+	announcedTrailers := len(response.Trailer)
+	if announcedTrailers > 0 {
+		writer.Header().Add(Trailer, trailerNames(response.Trailer))
 	}
-	written, copyErr := io.Copy(writer, response.Body)
-	if copyErr != nil {
-		mux.ctx.log.Errorf("Error copying upstream response Body: %v", err)
-		mux.ctx.errHandler.ServeHTTP(writer, request, err)
-		return
+	writer.WriteHeader(response.StatusCode)
+	if _, copyErr := mux.copyResponse(writer, response.Body, mux.flushIntervalFor(handler, response)); copyErr != nil {
+		// The status line has already gone out, so all that is left to do
+		// is record the failure; the client sees a truncated body.
+		log.Errorf("Error copying upstream response Body: %v", copyErr)
+		return handler
+	}
+	if len(response.Trailer) > 0 {
+		// Force a chunked response so net/http does not compute a
+		// Content-Length for a short body, leaving no room for trailers.
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		copyTrailers(writer.Header(), response.Trailer, announcedTrailers)
 	}
+	return handler
+}
 
-	if written != 0 {
-		writer.Header().Set(ContentLength, strconv.FormatInt(written, 10))
+//CopyHeaders adds headers to a response
+func CopyHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
 	}
+}
 
-	if err != nil {
-		log.Printf("%s", err)
+// acceptsTrailers reports whether the client announced with "Te: trailers"
+// that it reads trailer fields.
+func acceptsTrailers(h http.Header) bool {
+	for _, v := range h[Te] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	defer response.Body.Close()
+// trailerNames lists the trailers a response announces.
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for k := range trailer {
+		names = append(names, k)
+	}
+	return strings.Join(names, ", ")
 }
 
-//CopyHeaders adds headers to a response
-func CopyHeaders(dst, src http.Header) {
-	for k, vv := range src {
+// copyTrailers sends the trailers the backend sent after the body.  Those
+// announced up front are set directly; any the backend added without
+// announcing them, as HTTP/2 allows, are sent with http.TrailerPrefix.
+func copyTrailers(dst, trailer http.Header, announced int) {
+	prefix := ""
+	if len(trailer) != announced {
+		prefix = http.TrailerPrefix
+	}
+	for k, vv := range trailer {
 		for _, v := range vv {
-			dst.Add(k, v)
+			dst.Add(prefix+k, v)
 		}
 	}
 }
@@ -423,57 +715,97 @@ func CopyURL(i *url.URL) *url.URL {
 	return &out
 }
 
-func (mux *Mux) generateInnerRequest(request *http.Request, u *url.URL, address string) *http.Request {
+func (mux *Mux) generateInnerRequest(log Logger, request *http.Request, handler *PatternHandler, address string, principal *Principal) *http.Request {
 	innerRequest := new(http.Request)
 	*innerRequest = *request // includes shallow copies of maps, but we handle this below
 	innerRequest.URL = CopyURL(request.URL)
-	innerRequest.URL.Scheme = "http"
+	innerRequest.URL.Scheme = mux.upstreamFor(address).scheme
 	innerRequest.URL.Host = address
-	innerRequest.Host = address
-	innerRequest.URL.Path = strings.Replace(request.URL.Path, "/api", "", 1)
+	if handler == nil || handler.Route == nil || !handler.Route.GRPC {
+		innerRequest.URL.Path = strings.Replace(request.URL.Path, "/api", "", 1)
+	}
 	innerRequest.URL.RawQuery = request.URL.RawQuery
 	innerRequest.RequestURI = ""
 	innerRequest.Header = make(http.Header)
 	innerRequest.Close = false
+	if request.ContentLength == 0 {
+		// A nil body lets the transport retry idempotent requests on a
+		// fresh connection.
+		innerRequest.Body = nil
+	}
 	CopyHeaders(innerRequest.Header, request.Header)
 	if mux.rewriter != nil {
 		mux.rewriter.Rewrite(innerRequest)
 	}
-	dump, err := httputil.DumpRequestOut(innerRequest, true)
-	if err != nil {
-		log.Fatal(err)
+	// The rewriter records the host the client asked for before it is
+	// replaced with the backend's.
+	innerRequest.Host = address
+	setClientCertHeaders(innerRequest.Header, request.TLS)
+	if handler != nil {
+		setPrincipalHeaders(innerRequest.Header, handler.Route, principal)
+		if handler.Route != nil && handler.Route.APIKey {
+			stripAPIKey(innerRequest)
+		}
+		mux.setAssertion(innerRequest, handler, principal)
+	}
+	// Te is hop-by-hop, but "trailers" tells the backend the client can read
+	// trailers, which gRPC servers insist on.
+	if acceptsTrailers(request.Header) {
+		innerRequest.Header.Set(Te, "trailers")
+	}
+	// The rewriter strips hop-by-hop headers, but a protocol switch has to
+	// be requested from the backend explicitly.
+	if reqUpType := upgradeType(request.Header); reqUpType != "" {
+		innerRequest.Header.Set(Connection, "Upgrade")
+		innerRequest.Header.Set(Upgrade, request.Header.Get(Upgrade))
 	}
-	log.Printf("Executing: %q", dump)
+	mux.dump.dumpRequestOut(log, "Executing", innerRequest)
 	return innerRequest
 }
 
-func findHost(mux *Mux, request *http.Request, writer http.ResponseWriter, address *string) error {
-	addresses, err := mux.Match(request.Method, request.URL.Path)
+func findHost(mux *Mux, request *http.Request, writer http.ResponseWriter, address *string) (*PatternHandler, error) {
+	handler, err := mux.match(request.Method, request.URL.Path)
 	// TODO: Add JSON response here
+	if err != nil && isGRPC(request.Header) {
+		mux.ctx.errHandler.ServeHTTP(writer, request, &StatusError{Code: http.StatusNotFound, Message: "unknown method " + request.URL.Path})
+		return nil, err
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusNotFound)
 		writer.Header().Set("Content-Type", "application/json")
 		jsonStr := `[{"error":"404 Status Not Found"},{"status":404}]`
 		writer.Write([]byte(jsonStr))
-		return errors.New("No Matching Pattern")
+		return nil, errors.New("No Matching Pattern")
 	}
 	// Make a request to a random backend service.
-	index := rand.Intn(len(*addresses))
-	*address = (*addresses)[index]
-	return nil
+	index := rand.Intn(len(handler.Addresses))
+	*address = handler.Addresses[index]
+	return handler, nil
 }
 
 // Match finds backend service addresses capable of handling a request for the
 // given HTTP method and URL pattern.  An error is returned if no addresses
 // are registered for the given HTTP method and URL pattern.
 func (mux *Mux) Match(method, pattern string) (*[]string, error) {
+	handler, err := mux.match(method, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &handler.Addresses, nil
+}
+
+func (mux *Mux) match(method, pattern string) (*PatternHandler, error) {
 	mux.rw.RLock()
 	defer mux.rw.RUnlock()
 	handlers, present := mux.routes[method]
 	if present {
 		for _, handler := range handlers {
 			if handler.Match(pattern) {
-				return &handler.Addresses, nil
+				// Hand out a copy, as Add and remove update handlers in
+				// place while requests are being served.
+				matched := *handler
+				matched.Addresses = append([]string(nil), handler.Addresses...)
+				return &matched, nil
 			}
 		}
 	} else {
@@ -482,6 +814,14 @@ func (mux *Mux) Match(method, pattern string) (*[]string, error) {
 	return nil, errors.New("No matching address")
 }
 
+// name identifies the handler's route in logs and metrics.
+func (handler *PatternHandler) name() string {
+	if handler.Route != nil {
+		return routeName(handler.Route)
+	}
+	return handler.Pattern
+}
+
 // Match returns true if this handler is a match for path.
 func (handler *PatternHandler) Match(path string) bool {
 	var i, j int
@@ -0,0 +1,195 @@
+package moria_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+// newGateway starts a backend running handler and a gateway that routes
+// method and /api+path to it.
+func newGateway(t testing.TB, method, path string, handler http.Handler) (*moria.Mux, *httptest.Server, *httptest.Server) {
+	return newGatewayRoutes(t, []moria.EtcdRoute{{Method: method, Path: path}}, handler)
+}
+
+// newGatewayRoutes starts a backend running handler and a gateway that
+// registers routes for it the way the exchange does.
+func newGatewayRoutes(t testing.TB, routes []moria.EtcdRoute, handler http.Handler) (*moria.Mux, *httptest.Server, *httptest.Server) {
+	backend := httptest.NewServer(handler)
+	mux := routeTo(t, backend, routes)
+	return mux, backend, httptest.NewServer(mux)
+}
+
+// newRoutedMux returns a mux routing routes to a backend running handler,
+// for tests that call the mux directly.  The backend stops with the test.
+func newRoutedMux(t testing.TB, routes []moria.EtcdRoute, handler http.Handler) *moria.Mux {
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	return routeTo(t, backend, routes)
+}
+
+// routeTo returns a mux with routes registered for backend.
+func routeTo(t testing.TB, backend *httptest.Server, routes []moria.EtcdRoute) *moria.Mux {
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &moria.ServiceRecord{ID: "test-service-1", Name: "test-service", Address: u.Host}
+	record.GenerateRecord(routes)
+	mux := moria.NewMux()
+	register(mux, record)
+	return mux
+}
+
+// serve passes a request carrying header through mux and records the
+// response.
+func serve(mux *moria.Mux, method, url string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, url, body)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// register adds every route of a service record to mux the way the exchange
+// does.
+func register(mux *moria.Mux, record *moria.ServiceRecord) {
+	for method, patterns := range record.Routes {
+		for _, path := range patterns {
+			mux.AddRoute(method, record.Pattern(method, path), record.Route(method, path), record.Address, record.ID, record, nil)
+		}
+	}
+}
+
+// zeroReader produces an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestMuxStreamsResponseBody(t *testing.T) {
+	const size = 8 << 20
+	_, backend, gateway := newGateway(t, "GET", "/download", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, io.LimitReader(zeroReader{}, size))
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	res, err := http.Get(gateway.URL + "/api/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Errorf("Expected %d bytes got %d", size, n)
+	}
+}
+
+func TestMuxStreamsRequestBody(t *testing.T) {
+	const size = 8 << 20
+	_, backend, gateway := newGateway(t, "POST", "/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	res, err := http.Post(gateway.URL+"/api/upload", "application/octet-stream", io.LimitReader(zeroReader{}, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != fmt.Sprint(size) {
+		t.Errorf("Expected backend to receive %d bytes got %s", size, body)
+	}
+}
+
+func TestMuxNotFound(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/exists", http.NotFoundHandler())
+	defer backend.Close()
+	defer gateway.Close()
+
+	res, err := http.Get(gateway.URL + "/api/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %d got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+// The allocated bytes per operation should stay flat as the payload grows,
+// showing that bodies are streamed rather than buffered.
+func BenchmarkMuxDownload(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			_, backend, gateway := newGateway(b, "GET", "/download", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, io.LimitReader(zeroReader{}, size))
+			}))
+			defer backend.Close()
+			defer gateway.Close()
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := http.Get(gateway.URL + "/api/download")
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkMuxUpload(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			_, backend, gateway := newGateway(b, "POST", "/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(ioutil.Discard, r.Body)
+			}))
+			defer backend.Close()
+			defer gateway.Close()
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res, err := http.Post(gateway.URL+"/api/upload", "application/octet-stream", io.LimitReader(zeroReader{}, size))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestDumpingIsOptIn(t *testing.T) {
+	cfg := moria.Dumping()
+	if cfg.Enabled {
+		t.Error("Expected body dumping to be disabled by default")
+	}
+	if cfg.Limit <= 0 {
+		t.Errorf("Expected a positive default dump limit got %d", cfg.Limit)
+	}
+}
@@ -0,0 +1,275 @@
+package moria
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted peer may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolCIDRs reads PROXY_PROTOCOL_CIDRS, a comma separated list of
+// networks or addresses, such as a load balancer's subnet, allowed to send
+// PROXY protocol headers.  It returns nil when the variable is not set.
+func ProxyProtocolCIDRs() ([]*net.IPNet, error) {
+	return ParseCIDRs(os.Getenv("PROXY_PROTOCOL_CIDRS"))
+}
+
+// ParseCIDRs parses a comma separated list of networks.  Bare addresses are
+// treated as single host networks.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is inside any of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a TCP address, or nil for other kinds.
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// NewProxyListener wraps ln so that connections from trusted networks may
+// start with a PROXY protocol v1 or v2 header, as sent by TCP load balancers.
+// The client address in the header then becomes the connection's
+// RemoteAddr.  Connections from anywhere else are passed through untouched.
+func NewProxyListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: ln, trusted: trusted, log: defaultLogger}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	log     Logger // Where invalid headers are reported.
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !containsIP(l.trusted, addrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	// The header is read on first use rather than here, so a slow peer
+	// cannot hold up Accept for everyone else.
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), log: l.log}, nil
+}
+
+// proxyConn is a connection from a trusted peer whose PROXY header, if any,
+// is consumed before the first read.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	log    Logger
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.log.Warningf("Invalid PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader consumes a PROXY protocol header from r and returns the
+// source and destination it carries.  Nil addresses mean the connection is
+// used as is: no header was sent, or it was a health check from the proxy
+// itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return readProxyV1(r)
+		}
+	case proxyV2Signature[0]:
+		if prefix, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(prefix, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil, nil
+}
+
+// readProxyV1 parses the text format, e.g.
+//
+//	PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header is not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyV1Addr(host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 parses the binary format: the signature, a version and command
+// byte, an address family byte, a length and the addresses, followed by
+// optional TLVs which are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch command {
+	case 0x0: // LOCAL: the proxy's own connection, e.g. a health check.
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// UDP and UNIX sockets carry nothing useful for HTTP.
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("v2 address block is too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[:size]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return src, dst, nil
+}
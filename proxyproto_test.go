@@ -0,0 +1,127 @@
+package moria_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// proxyServer serves the client address each request arrives from behind a
+// PROXY protocol listener trusting cidrs.
+func proxyServer(t *testing.T, cidrs string) (string, func()) {
+	trusted, err := moria.ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(moria.NewProxyListener(ln, trusted))
+	return ln.Addr().String(), func() { server.Close() }
+}
+
+// getAfterHeader sends header followed by a GET request over a fresh
+// connection and returns the response.
+func getAfterHeader(t *testing.T, addr string, header []byte) (*http.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(header)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: gateway\r\nConnection: close\r\n\r\n")
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func remoteAddrAfter(t *testing.T, addr string, header []byte) string {
+	response, err := getAfterHeader(t, addr, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	return string(body)
+}
+
+func proxyV2Header(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	family := byte(0x11)
+	if src.To4() == nil {
+		family = 0x21
+	} else {
+		src, dst = src.To4(), dst.To4()
+	}
+	header = append(header, 0x21, family, 0, 0)
+	header = append(header, src...)
+	header = append(header, dst...)
+	header = append(header, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	// A TLV the gateway does not understand must be skipped.
+	header = append(header, 0x04, 0x00, 0x01, 0xff)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(header)-16))
+	return header
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	addr, stop := proxyServer(t, "127.0.0.0/8")
+	defer stop()
+	got := remoteAddrAfter(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"))
+	if got != "203.0.113.7:51234" {
+		t.Errorf("Expected 203.0.113.7:51234 got %v", got)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	addr, stop := proxyServer(t, "127.0.0.1")
+	defer stop()
+	got := remoteAddrAfter(t, addr, proxyV2Header(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), 51234, 443))
+	if got != "[2001:db8::7]:51234" {
+		t.Errorf("Expected [2001:db8::7]:51234 got %v", got)
+	}
+	got = remoteAddrAfter(t, addr, proxyV2Header(net.ParseIP("198.51.100.9"), net.ParseIP("10.0.0.1"), 4000, 80))
+	if got != "198.51.100.9:4000" {
+		t.Errorf("Expected 198.51.100.9:4000 got %v", got)
+	}
+}
+
+func TestProxyProtocolOptionalForTrustedPeers(t *testing.T) {
+	addr, stop := proxyServer(t, "127.0.0.0/8")
+	defer stop()
+	if host, _, _ := net.SplitHostPort(remoteAddrAfter(t, addr, nil)); host != "127.0.0.1" {
+		t.Errorf("Expected the peer address without a header got %v", host)
+	}
+	if host, _, _ := net.SplitHostPort(remoteAddrAfter(t, addr, []byte("PROXY UNKNOWN\r\n"))); host != "127.0.0.1" {
+		t.Errorf("Expected the peer address for UNKNOWN got %v", host)
+	}
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	addr, stop := proxyServer(t, "10.0.0.0/8")
+	defer stop()
+	response, err := getAfterHeader(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a header from an untrusted peer to be rejected as HTTP got %v", response.StatusCode)
+	}
+}
+
+func TestProxyProtocolMalformed(t *testing.T) {
+	addr, stop := proxyServer(t, "127.0.0.0/8")
+	defer stop()
+	if _, err := getAfterHeader(t, addr, []byte("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n")); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
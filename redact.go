@@ -0,0 +1,209 @@
+package moria
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in logs and dumps.
+const Redacted = "[REDACTED]"
+
+// Secrets that are always masked.  Configuration can add to these lists but
+// never remove from them.
+var (
+	defaultRedactedHeaders = []string{
+		"Authorization", "Proxy-Authorization", XAPIKey, XGatewayAssertion,
+		"X-Auth-Token", "X-Csrf-Token", "X-Xsrf-Token",
+	}
+	defaultRedactedParams = []string{
+		apiKeyParam, "access_token", "refresh_token", "id_token", "token", "code",
+		"client_secret", "password", "secret", "signature", "sig",
+	}
+	defaultRedactedFields = []string{
+		"password", "passwd", "pass", "secret", "client_secret", "token", "access_token",
+		"refresh_token", "id_token", "api_key", "private_key", "authorization",
+		"card_number", "pan", "cvv", "cvc", "security_code", "ssn",
+	}
+)
+
+// jsonField matches a JSON member with a scalar value, so fields can be
+// masked in bodies that are truncated or not quite valid.  A string cut off
+// by the end of a truncated body counts as a value.
+var jsonField = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)("(?:[^"\\]|\\.)*"|"(?:[^"\\]|\\.)*\\?$|-?[0-9][0-9.eE+-]*|true|false)`)
+
+// Redactor masks secrets in the headers, query strings and bodies that the
+// gateway logs.  Cookie values are always masked, leaving their names.
+type Redactor struct {
+	headers map[string]bool
+	params  map[string]bool
+	fields  map[string]bool
+}
+
+// DefaultRedactor masks the default set of secrets.
+var DefaultRedactor = NewRedactor(nil, nil, nil)
+
+// NewRedactor returns a redactor masking the given header names, query and
+// form parameters, and JSON body fields on top of the defaults.  Parameter
+// and field names match regardless of case, "_" and "-", so "card_number"
+// also masks "cardNumber".
+func NewRedactor(headers, params, fields []string) *Redactor {
+	r := &Redactor{headers: make(map[string]bool), params: make(map[string]bool), fields: make(map[string]bool)}
+	for _, name := range append(append([]string{}, defaultRedactedHeaders...), headers...) {
+		r.headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	for _, name := range append(append([]string{}, defaultRedactedParams...), params...) {
+		r.params[normalizeField(name)] = true
+	}
+	for _, name := range append(append([]string{}, defaultRedactedFields...), fields...) {
+		r.fields[normalizeField(name)] = true
+	}
+	return r
+}
+
+// Redaction reads REDACT_HEADERS, REDACT_PARAMS and REDACT_FIELDS, comma
+// separated lists of extra names to mask.
+func Redaction() *Redactor {
+	return NewRedactor(
+		splitHeaderList([]string{os.Getenv("REDACT_HEADERS")}),
+		splitHeaderList([]string{os.Getenv("REDACT_PARAMS")}),
+		splitHeaderList([]string{os.Getenv("REDACT_FIELDS")}),
+	)
+}
+
+func normalizeField(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.TrimSpace(name)))
+}
+
+// Header returns a copy of h with secrets masked.
+func (r *Redactor) Header(h http.Header) http.Header {
+	masked := make(http.Header, len(h))
+	for name, values := range h {
+		canonical := http.CanonicalHeaderKey(name)
+		copied := make([]string, len(values))
+		for i, value := range values {
+			switch {
+			case r.headers[canonical]:
+				copied[i] = Redacted
+			case canonical == "Cookie":
+				copied[i] = redactCookies(value)
+			case canonical == "Set-Cookie":
+				copied[i] = redactSetCookie(value)
+			default:
+				copied[i] = value
+			}
+		}
+		masked[name] = copied
+	}
+	return masked
+}
+
+// redactCookies masks every value in a Cookie header.
+func redactCookies(value string) string {
+	pairs := strings.Split(value, ";")
+	for i, pair := range pairs {
+		if eq := strings.Index(pair, "="); eq >= 0 {
+			pairs[i] = pair[:eq+1] + Redacted
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// redactSetCookie masks the value of a Set-Cookie header, keeping its
+// attributes.
+func redactSetCookie(value string) string {
+	end := strings.Index(value, ";")
+	if end < 0 {
+		end = len(value)
+	}
+	if eq := strings.Index(value[:end], "="); eq >= 0 {
+		return value[:eq+1] + Redacted + value[end:]
+	}
+	return value
+}
+
+// Query masks secret parameters in an encoded query or form body.  Anything
+// that cannot be parsed is left as is apart from the parameters found.
+func (r *Redactor) Query(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	pairs := strings.Split(raw, "&")
+	for i, pair := range pairs {
+		name := pair
+		if eq := strings.Index(pair, "="); eq >= 0 {
+			name = pair[:eq]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if r.params[normalizeField(name)] && strings.Contains(pair, "=") {
+			pairs[i] = pair[:strings.Index(pair, "=")+1] + Redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// URL returns u as a string with secret parameters and any password masked.
+func (r *Redactor) URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	masked := *u
+	masked.RawQuery = r.Query(u.RawQuery)
+	if _, ok := u.User.Password(); ok {
+		masked.User = url.UserPassword(u.User.Username(), Redacted)
+	}
+	return masked.String()
+}
+
+// JSON masks the scalar values of secret fields in a JSON document, which
+// may be truncated.
+func (r *Redactor) JSON(body []byte) []byte {
+	return jsonField.ReplaceAllFunc(body, func(member []byte) []byte {
+		parts := jsonField.FindSubmatch(member)
+		if !r.fields[normalizeField(string(parts[1]))] {
+			return member
+		}
+		masked := append([]byte{}, member[:len(member)-len(parts[3])]...)
+		return append(masked, `"`+Redacted+`"`...)
+	})
+}
+
+// Body masks secrets in a captured body of the given content type.  Bodies
+// that are neither JSON nor form encoded are returned unchanged.
+func (r *Redactor) Body(contentType string, body []byte) []byte {
+	contentType = strings.ToLower(contentType)
+	switch {
+	case strings.Contains(contentType, "json"):
+		return r.JSON(body)
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		return []byte(r.Query(string(body)))
+	}
+	return body
+}
+
+// Request returns a shallow copy of request, safe to dump, with its headers
+// and query string masked.
+func (r *Redactor) Request(request *http.Request) *http.Request {
+	masked := *request
+	masked.Header = r.Header(request.Header)
+	if request.URL != nil {
+		u := *request.URL
+		u.RawQuery = r.Query(u.RawQuery)
+		masked.URL = &u
+	}
+	// RequestURI would be dumped verbatim in place of the masked URL.
+	masked.RequestURI = ""
+	return &masked
+}
+
+// Response returns a shallow copy of response, safe to dump, with its
+// headers masked.
+func (r *Redactor) Response(response *http.Response) *http.Response {
+	masked := *response
+	masked.Header = r.Header(response.Header)
+	return &masked
+}
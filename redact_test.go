@@ -0,0 +1,141 @@
+package moria_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	r := moria.NewRedactor([]string{"x-session"}, nil, nil)
+	masked := r.Header(http.Header{
+		"Authorization": {"Bearer abc"},
+		"X-Session":     {"s3"},
+		"Cookie":        {"sid=abc; theme=dark"},
+		"Set-Cookie":    {"sid=abc; Path=/; HttpOnly"},
+		"Accept":        {"application/json"},
+	})
+	expected := map[string]string{
+		"Authorization": "[REDACTED]",
+		"X-Session":     "[REDACTED]",
+		"Cookie":        "sid=[REDACTED]; theme=[REDACTED]",
+		"Set-Cookie":    "sid=[REDACTED]; Path=/; HttpOnly",
+		"Accept":        "application/json",
+	}
+	for name, value := range expected {
+		if got := masked.Get(name); got != value {
+			t.Errorf("Expected %v: %v got %v", name, value, got)
+		}
+	}
+}
+
+func TestRedactQueryAndURL(t *testing.T) {
+	r := moria.NewRedactor(nil, []string{"ssn"}, nil)
+	u, _ := url.Parse("https://user:pw@example.com/orders?page=2&api_key=k1&Access-Token=t&ssn=123")
+	got := r.URL(u)
+	for _, secret := range []string{"pw", "k1", "=t", "123"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("Expected %q to be masked in %v", secret, got)
+		}
+	}
+	if !strings.Contains(got, "page=2") {
+		t.Errorf("Expected other parameters to be kept got %v", got)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	r := moria.NewRedactor(nil, nil, []string{"iban"})
+	body := `{"user":"ann","password":"hunter2","card":{"cardNumber":4111111111111111,"cvv":"123"},"IBAN":"DE89","note":"password"`
+	got := string(r.Body("application/json; charset=utf-8", []byte(body)))
+	for _, secret := range []string{"hunter2", "4111111111111111", `"123"`, "DE89"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("Expected %q to be masked in %v", secret, got)
+		}
+	}
+	if !strings.Contains(got, `"user":"ann"`) || !strings.Contains(got, `"note":"password"`) {
+		t.Errorf("Expected other fields to be kept got %v", got)
+	}
+}
+
+func TestRedactTruncatedJSON(t *testing.T) {
+	for _, body := range []string{`{"user":"ann","password":"hunter2`, `{"user":"ann","password": "hunter2\`, `{"user":"ann","token":"hunter2\"x`} {
+		got := string(moria.DefaultRedactor.JSON([]byte(body)))
+		if strings.Contains(got, "hunter2") || !strings.Contains(got, `"user":"ann"`) {
+			t.Errorf("Expected the cut off secret in %v to be masked got %v", body, got)
+		}
+	}
+}
+
+func TestRedactDefaultsAlwaysApply(t *testing.T) {
+	os.Setenv("REDACT_HEADERS", "")
+	os.Setenv("REDACT_FIELDS", "nickname")
+	defer os.Unsetenv("REDACT_HEADERS")
+	defer os.Unsetenv("REDACT_FIELDS")
+	r := moria.Redaction()
+	if got := r.Header(http.Header{"Authorization": {"Bearer abc"}}).Get("Authorization"); got != moria.Redacted {
+		t.Errorf("Expected Authorization to be masked regardless of config got %v", got)
+	}
+	if got := string(r.JSON([]byte(`{"password":"x","nickname":"y"}`))); strings.Contains(got, `"x"`) || strings.Contains(got, `"y"`) {
+		t.Errorf("Expected default and configured fields to be masked got %v", got)
+	}
+}
+
+// syncBuffer collects log output written from other goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDumpsAreRedacted(t *testing.T) {
+	os.Setenv("DUMP_BODIES", "true")
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "POST", Path: "/login"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "session-secret"})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"issued-token"}`))
+		}))
+	os.Unsetenv("DUMP_BODIES")
+	defer backend.Close()
+	defer gateway.Close()
+	logs := &syncBuffer{}
+	mux.SetLogger(moria.NewStructuredLogger(logs, moria.INFO, moria.LogfmtFormat))
+
+	request, _ := http.NewRequest("POST", gateway.URL+"/api/login?api_key=query-secret", strings.NewReader(`{"user":"ann","password":"hunter2"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Basic YW5uOmh1bnRlcjI=")
+	request.Header.Set("Cookie", "sid=cookie-secret")
+	if status, _ := do(t, request); status != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", status)
+	}
+	// The response body is logged once the gateway has read all of it.
+	eventually(t, func() bool { return strings.Contains(logs.String(), "access_token") })
+	dumped := logs.String()
+	for _, secret := range []string{"query-secret", "hunter2", "YW5uOmh1bnRlcjI=", "cookie-secret", "session-secret", "issued-token"} {
+		if strings.Contains(dumped, secret) {
+			t.Errorf("Expected %q to be masked in the logs", secret)
+		}
+	}
+	if !strings.Contains(dumped, "ann") {
+		t.Errorf("Expected the dumps to be logged got %v", dumped)
+	}
+}
@@ -0,0 +1,71 @@
+package moria
+
+import (
+	"sync"
+
+	"github.com/coreos/etcd/client"
+)
+
+// Secrets holds named shared secrets, such as webhook signing keys, as
+// stored under /gateway/secrets/<env>/<name> in etcd.
+type Secrets struct {
+	mu      sync.RWMutex
+	secrets map[string][]byte
+	log     Logger
+}
+
+// NewSecrets returns an empty set of secrets.
+func NewSecrets() *Secrets {
+	return &Secrets{secrets: make(map[string][]byte)}
+}
+
+// Set stores a secret.
+func (s *Secrets) Set(name string, secret []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[name] = secret
+}
+
+// Remove forgets a secret.
+func (s *Secrets) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, name)
+}
+
+// Get returns a secret.
+func (s *Secrets) Get(name string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secret, ok := s.secrets[name]
+	return secret, ok
+}
+
+// Follow keeps the secrets in step with a store.  Values are never logged.
+func (s *Secrets) Follow(store *Store) {
+	store.OnChange(func(name, value string, deleted bool) {
+		if deleted {
+			s.Remove(name)
+			store.logger().Infof("Removed secret %v", name)
+			return
+		}
+		s.Set(name, []byte(value))
+		store.logger().Infof("Loaded secret %v", name)
+	})
+}
+
+// ConfigureSecrets loads the secrets stored under /gateway/secrets/<env> in
+// etcd and keeps them up to date.
+func ConfigureSecrets(secrets *Secrets, c client.KeysAPI) {
+	if c == nil {
+		return
+	}
+	store := NewStore(GatewayKey("secrets"), c)
+	store.log = secrets.log
+	secrets.Follow(store)
+	if err := store.Init(); err != nil {
+		store.logger().Errorf("Unable to load secrets from etcd: %v", err)
+		return
+	}
+	go store.Watch()
+}
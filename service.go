@@ -1,6 +1,7 @@
 package moria
 
 import (
+	"net/http"
 	"strings"
 )
 
@@ -10,21 +11,87 @@ type Routes map[string][]string
 // ServiceRecord is a representation of a service stored in etcd and used by
 // exchanges.
 type ServiceRecord struct {
-	ID      string `json:"id"`
-	Name    string `json:"name,omitempty"`
-	Address string `json:"address"`
-	Routes  Routes `json:"routes"`
+	ID      string                `json:"id"`
+	Name    string                `json:"name,omitempty"`
+	Address string                `json:"address"`
+	Routes  Routes                `json:"routes"`
+	Options map[string]*EtcdRoute `json:"-"` // Route definitions keyed by method and path.
+	Config  *ServiceConfig        `json:"-"` // Settings from the service's config key.
+}
+
+// ServiceConfig holds service wide gateway settings stored as JSON next to a
+// service's routes and hosts, e.g. /services/<name>/<env>/config.
+type ServiceConfig struct {
+	Upstream *UpstreamConfig `json:"upstream,omitempty"` // How the gateway connects to the service.
+	CORS     *CORSPolicy     `json:"cors,omitempty"`     // Cross-origin policy for the service's routes.
+	IP       *IPPolicy       `json:"ip,omitempty"`       // Client addresses allowed to reach the service.
 }
 
 // GenerateRecord Creates a service record for the grape etcd path export
 func (s *ServiceRecord) GenerateRecord(routes []EtcdRoute) {
 	s.Routes = make(Routes, 0)
-	for _, r := range routes {
+	s.Options = make(map[string]*EtcdRoute)
+	for i, r := range routes {
+		if r.GRPC && r.Method == "" {
+			// gRPC calls are always POSTs.
+			routes[i].Method = http.MethodPost
+			r.Method = http.MethodPost
+		}
 		routesArray, present := s.Routes[r.Method]
 		if !present {
 			routesArray = make([]string, 0)
 			s.Routes[r.Method] = routesArray
 		}
-		s.Routes[r.Method] = append(s.Routes[r.Method], strings.Replace(r.Path, "(.:format)", "", -1))
+		path := strings.Replace(r.Path, "(.:format)", "", -1)
+		s.Routes[r.Method] = append(s.Routes[r.Method], path)
+		s.Options[routeKey(r.Method, path)] = &routes[i]
+	}
+}
+
+// Route returns the definition a route was registered with, or nil if the
+// service does not expose it.
+func (s *ServiceRecord) Route(method, path string) *EtcdRoute {
+	if s == nil || s.Options == nil {
+		return nil
 	}
+	return s.Options[routeKey(method, path)]
+}
+
+// Pattern returns the mux pattern a route is served on.  REST routes live
+// below /api, while gRPC methods keep the /package.Service/Method path their
+// clients call.
+func (s *ServiceRecord) Pattern(method, path string) string {
+	if route := s.Route(method, path); route != nil && route.GRPC {
+		return path
+	}
+	return "/api" + path
+}
+
+// routeForPattern returns the definition of the route served on a mux
+// pattern, or nil if the service does not expose it.  gRPC methods are
+// served on their own path, which may well start with "/api".
+func (s *ServiceRecord) routeForPattern(method, pattern string) *EtcdRoute {
+	if route := s.Route(method, pattern); route != nil && route.GRPC {
+		return route
+	}
+	if !strings.HasPrefix(pattern, "/api") {
+		return nil
+	}
+	if route := s.Route(method, strings.TrimPrefix(pattern, "/api")); route != nil && !route.GRPC {
+		return route
+	}
+	return nil
+}
+
+// routeName identifies a route the way it is written in scopes, e.g.
+// "GET /orders/:id".
+func routeName(route *EtcdRoute) string {
+	if route == nil {
+		return ""
+	}
+	return routeKey(route.Method, strings.Replace(route.Path, "(.:format)", "", -1))
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
 }
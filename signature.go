@@ -0,0 +1,201 @@
+package moria
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSignatureTolerance is how far a signed timestamp may be from
+	// the gateway's clock.
+	defaultSignatureTolerance = 5 * time.Minute
+	// maxSignedBody caps the request bodies buffered to be verified.
+	maxSignedBody = 1 << 20
+)
+
+// SignaturePolicy declares that requests to a route, typically webhooks from
+// a third party, carry an HMAC of their contents, e.g.
+//
+//	{"method": "POST", "path": "/webhooks/stripe", "signature": {"secret": "stripe", "header": "X-Signature", "timestamp_header": "X-Timestamp", "canonical": ["timestamp", "body"], "separator": "."}}
+//
+// The HMAC is computed over the Canonical components joined by Separator.
+// Components are method, path, query, timestamp, body and header:<Name>.  The
+// timestamp is what stops signed requests from being replayed, so policies
+// without a TimestampHeader, or whose canonical form leaves the timestamp
+// out, are refused and their routes reject every request.
+type SignaturePolicy struct {
+	Secret          string   `json:"secret"`                     // Name of the secret under /gateway/secrets/<env>.
+	Header          string   `json:"header"`                     // Header holding the signature.
+	Prefix          string   `json:"prefix,omitempty"`           // Removed from the signature, e.g. "sha256=".
+	Algorithm       string   `json:"algorithm,omitempty"`        // sha256 (the default), sha1 or sha512.
+	Encoding        string   `json:"encoding,omitempty"`         // hex (the default) or base64.
+	TimestampHeader string   `json:"timestamp_header,omitempty"` // Header holding the signing time in Unix seconds, required.
+	Tolerance       string   `json:"tolerance,omitempty"`        // Accepted clock difference, 5m by default.
+	Canonical       []string `json:"canonical,omitempty"`        // Signed components, method, path, timestamp and body by default.
+	Separator       *string  `json:"separator,omitempty"`        // Joins the components, a newline by default.
+}
+
+// checkSignature verifies a signed request before it is proxied.  The body
+// is read to compute the HMAC and replaced so it can still be forwarded.
+func (mux *Mux) checkSignature(request *http.Request, policy *SignaturePolicy) error {
+	if !policy.signsTimestamp() {
+		mux.ctx.log.Warningf("Signature policy for secret %q does not sign a timestamp, refusing requests", policy.Secret)
+		return &StatusError{Code: http.StatusInternalServerError, Message: "signature policy does not sign a timestamp"}
+	}
+	secret, ok := mux.secrets.Get(policy.Secret)
+	if !ok {
+		mux.ctx.log.Warningf("No secret %q to verify signatures with", policy.Secret)
+		return &StatusError{Code: http.StatusInternalServerError, Message: "signature secret is not configured"}
+	}
+	newHash, err := signatureHash(policy.Algorithm)
+	if err != nil {
+		return &StatusError{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	signatures := presentedSignatures(request.Header.Get(policy.Header), policy.Prefix, policy.Encoding)
+	if len(signatures) == 0 {
+		return &StatusError{Code: http.StatusUnauthorized, Message: "missing request signature"}
+	}
+	timestamp := request.Header.Get(policy.TimestampHeader)
+	if err := checkTimestamp(timestamp, policy.Tolerance, time.Now()); err != nil {
+		return &StatusError{Code: http.StatusUnauthorized, Message: err.Error()}
+	}
+	var body []byte
+	if request.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(request.Body, maxSignedBody+1))
+		if err != nil {
+			return &StatusError{Code: http.StatusBadRequest, Message: "unable to read request body"}
+		}
+		if len(body) > maxSignedBody {
+			return &StatusError{Code: http.StatusRequestEntityTooLarge, Message: "signed request body is too large"}
+		}
+		request.Body.Close()
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+	}
+
+	mac := hmac.New(newHash, secret)
+	mac.Write(canonicalRequest(request, policy, timestamp, body))
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return &StatusError{Code: http.StatusUnauthorized, Message: "invalid request signature"}
+}
+
+// signsTimestamp reports whether requests carry a timestamp and the
+// signature covers it.
+func (policy *SignaturePolicy) signsTimestamp() bool {
+	if policy.TimestampHeader == "" {
+		return false
+	}
+	for _, component := range policy.canonical() {
+		if component == "timestamp" {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical returns the signed components.
+func (policy *SignaturePolicy) canonical() []string {
+	if len(policy.Canonical) == 0 {
+		return []string{"method", "path", "timestamp", "body"}
+	}
+	return policy.Canonical
+}
+
+func signatureHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %q", algorithm)
+}
+
+// presentedSignatures decodes the signatures in a header.  Several may be
+// sent, separated by commas or spaces, while a sender rotates secrets.
+func presentedSignatures(value, prefix, encoding string) [][]byte {
+	var signatures [][]byte
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		field = strings.TrimPrefix(field, prefix)
+		var signature []byte
+		var err error
+		if strings.ToLower(encoding) == "base64" {
+			signature, err = base64.StdEncoding.DecodeString(field)
+		} else {
+			signature, err = hex.DecodeString(field)
+		}
+		if err == nil && len(signature) > 0 {
+			signatures = append(signatures, signature)
+		}
+	}
+	return signatures
+}
+
+// checkTimestamp rejects requests signed too long ago, or too far in the
+// future, to be anything but replays.
+func checkTimestamp(timestamp, tolerance string, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid signature timestamp")
+	}
+	window := defaultSignatureTolerance
+	if d, err := time.ParseDuration(tolerance); err == nil && d > 0 {
+		window = d
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > window || skew < -window {
+		return errors.New("signature timestamp is outside the accepted window")
+	}
+	return nil
+}
+
+// canonicalRequest builds the bytes the sender signed.
+func canonicalRequest(request *http.Request, policy *SignaturePolicy, timestamp string, body []byte) []byte {
+	components := policy.canonical()
+	separator := "\n"
+	if policy.Separator != nil {
+		separator = *policy.Separator
+	}
+	var b bytes.Buffer
+	for i, component := range components {
+		if i > 0 {
+			b.WriteString(separator)
+		}
+		switch {
+		case component == "method":
+			b.WriteString(request.Method)
+		case component == "path":
+			b.WriteString(request.URL.EscapedPath())
+		case component == "query":
+			b.WriteString(request.URL.RawQuery)
+		case component == "timestamp":
+			b.WriteString(timestamp)
+		case component == "body":
+			b.Write(body)
+		case strings.HasPrefix(component, "header:"):
+			b.WriteString(request.Header.Get(strings.TrimPrefix(component, "header:")))
+		}
+	}
+	return b.Bytes()
+}
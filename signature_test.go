@@ -0,0 +1,153 @@
+package moria_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/context"
+)
+
+var webhookSecret = []byte("whsec_test")
+
+func hmacSHA256(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// newWebhookGateway serves POST /api/webhooks, signed according to policy,
+// from a backend echoing the body it receives.
+func newWebhookGateway(t *testing.T, policy *moria.SignaturePolicy) *moria.Mux {
+	return newRoutedMux(t, []moria.EtcdRoute{{Method: "POST", Path: "/webhooks", Signature: policy}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		}))
+}
+
+func postWebhook(mux *moria.Mux, body string, header http.Header) (int, string) {
+	recorder := serve(mux, "POST", "http://gateway/api/webhooks", strings.NewReader(body), header)
+	return recorder.Code, recorder.Body.String()
+}
+
+var defaultPolicy = &moria.SignaturePolicy{Secret: "partner", Header: "X-Signature", TimestampHeader: "X-Timestamp"}
+
+// signDefault signs a request the way defaultPolicy expects.
+func signDefault(body string, at time.Time) http.Header {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	signature := hmacSHA256(webhookSecret, "POST\n/api/webhooks\n"+timestamp+"\n"+body)
+	return http.Header{"X-Signature": {hex.EncodeToString(signature)}, "X-Timestamp": {timestamp}}
+}
+
+func TestSignatureVerified(t *testing.T) {
+	mux := newWebhookGateway(t, defaultPolicy)
+	mux.Secrets().Set("partner", webhookSecret)
+
+	body := `{"event":"order.paid"}`
+	if status, got := postWebhook(mux, body, signDefault(body, time.Now())); status != http.StatusOK || got != body {
+		t.Errorf("Expected 200 with the body forwarded got %d %v", status, got)
+	}
+}
+
+func TestSignatureRejected(t *testing.T) {
+	mux := newWebhookGateway(t, defaultPolicy)
+	mux.Secrets().Set("partner", webhookSecret)
+
+	body := `{"event":"order.paid"}`
+	tampered := signDefault(body, time.Now())
+	stale := signDefault(body, time.Now().Add(-10*time.Minute))
+	future := signDefault(body, time.Now().Add(10*time.Minute))
+	unsigned := signDefault(body, time.Now())
+	unsigned.Del("X-Signature")
+	cases := map[string]struct {
+		body   string
+		header http.Header
+	}{
+		"tampered body": {`{"event":"order.refunded"}`, tampered},
+		"replayed":      {body, stale},
+		"future":        {body, future},
+		"unsigned":      {body, unsigned},
+	}
+	for name, c := range cases {
+		if status, _ := postWebhook(mux, c.body, c.header); status != http.StatusUnauthorized {
+			t.Errorf("%v: expected 401 got %d", name, status)
+		}
+	}
+}
+
+func TestSignatureWithoutTimestampRefused(t *testing.T) {
+	for name, policy := range map[string]*moria.SignaturePolicy{
+		"no timestamp header": {Secret: "partner", Header: "X-Signature"},
+		"timestamp unsigned":  {Secret: "partner", Header: "X-Signature", TimestampHeader: "X-Timestamp", Canonical: []string{"method", "path", "body"}},
+	} {
+		mux := newWebhookGateway(t, policy)
+		mux.Secrets().Set("partner", webhookSecret)
+		body := `{"event":"order.paid"}`
+		header := http.Header{"X-Signature": {hex.EncodeToString(hmacSHA256(webhookSecret, "POST\n/api/webhooks\n\n"+body))}}
+		if policy.Canonical != nil {
+			header.Set("X-Signature", hex.EncodeToString(hmacSHA256(webhookSecret, "POST\n/api/webhooks\n"+body)))
+		}
+		if status, _ := postWebhook(mux, body, header); status != http.StatusInternalServerError {
+			t.Errorf("%v: expected the policy to be refused with 500 got %d", name, status)
+		}
+	}
+}
+
+func TestSignatureCanonicalForm(t *testing.T) {
+	separator := "."
+	mux := newWebhookGateway(t, &moria.SignaturePolicy{
+		Secret:          "partner",
+		Header:          "X-Hub-Signature",
+		Prefix:          "v1=",
+		Encoding:        "base64",
+		TimestampHeader: "X-Timestamp",
+		Tolerance:       "30s",
+		Canonical:       []string{"timestamp", "header:X-Delivery", "body"},
+		Separator:       &separator,
+	})
+	mux.Secrets().Set("partner", webhookSecret)
+
+	body := "payload"
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	good := base64.StdEncoding.EncodeToString(hmacSHA256(webhookSecret, timestamp+".42."+body))
+	old := base64.StdEncoding.EncodeToString(hmacSHA256([]byte("old secret"), timestamp+".42."+body))
+	header := http.Header{"X-Hub-Signature": {"v1=" + old + ", v1=" + good}, "X-Timestamp": {timestamp}, "X-Delivery": {"42"}}
+	if status, got := postWebhook(mux, body, header); status != http.StatusOK || got != body {
+		t.Errorf("Expected 200 for any matching signature got %d %v", status, got)
+	}
+	header.Set("X-Delivery", "43")
+	if status, _ := postWebhook(mux, body, header); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when a signed header changes got %d", status)
+	}
+}
+
+func TestSignatureSecretFromEtcd(t *testing.T) {
+	t.Setenv("VINE_ENV", "test")
+	mux := newWebhookGateway(t, defaultPolicy)
+	body := "{}"
+	if status, _ := postWebhook(mux, body, signDefault(body, time.Now())); status != http.StatusInternalServerError {
+		t.Errorf("Expected 500 without the secret got %d", status)
+	}
+
+	keys := newFakeKeys()
+	store := moria.NewStore(moria.GatewayKey("secrets"), keys)
+	mux.Secrets().Follow(store)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go store.Watch()
+	keys.Set(context.TODO(), "/gateway/secrets/test/partner", string(webhookSecret), nil)
+	eventually(t, func() bool {
+		status, _ := postWebhook(mux, body, signDefault(body, time.Now()))
+		return status == http.StatusOK
+	})
+}
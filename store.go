@@ -0,0 +1,185 @@
+package moria
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Watch retries failed watches after a delay that doubles up to
+// maxWatchBackoff.
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
+// GatewayKey returns the etcd directory holding gateway wide settings of the
+// given kind for the current environment, e.g. /gateway/certificates/staging.
+func GatewayKey(kind string) string {
+	return "/gateway/" + kind + "/" + os.Getenv("VINE_ENV")
+}
+
+// Store mirrors the keys directly below an etcd directory in memory and keeps
+// them current by watching the directory, the same way the exchange follows
+// service routes.
+type Store struct {
+	dir       string         // The etcd directory mirrored by the store.
+	client    client.KeysAPI // The etcd client.
+	waitIndex uint64         // Wait index to use when watching etcd.
+	log       Logger         // Where the store and those following it log.
+
+	mu       sync.RWMutex
+	values   map[string]string // Values keyed by the last element of their key.
+	onChange []func(name, value string, deleted bool)
+}
+
+// NewStore creates a store for an etcd directory.  Call Init to load it and
+// Watch to follow changes.
+func NewStore(dir string, client client.KeysAPI) *Store {
+	return &Store{
+		dir:    "/" + strings.Trim(dir, "/"),
+		client: client,
+		values: make(map[string]string),
+	}
+}
+
+// OnChange registers a function called whenever a value is set or deleted,
+// including for every value loaded by Init.
+func (s *Store) OnChange(f func(name, value string, deleted bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+// Init loads the current contents of the directory.  A directory that does
+// not exist yet is treated as empty.  Values loaded before that are gone now
+// are deleted.
+func (s *Store) Init() error {
+	current := make(map[string]string)
+	response, err := s.client.Get(context.TODO(), s.dir, EtcdGetOptions())
+	if err != nil {
+		cerr, ok := err.(client.Error)
+		if !ok || cerr.Code != client.ErrorCodeKeyNotFound {
+			return err
+		}
+		s.waitIndex = cerr.Index + 1
+	} else {
+		for _, node := range response.Node.Nodes {
+			if !node.Dir {
+				current[Tail(node.Key)] = node.Value
+			}
+		}
+		// We want to watch changes *after* this one.
+		s.waitIndex = response.Index + 1
+	}
+	s.mu.RLock()
+	var gone []string
+	for name := range s.values {
+		if _, ok := current[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	s.mu.RUnlock()
+	for _, name := range gone {
+		s.delete(name)
+	}
+	for name, value := range current {
+		s.set(name, value)
+	}
+	return nil
+}
+
+// Watch follows changes to the directory.  This blocking call never returns.
+// When etcd has compacted away the changes the watch was waiting for, the
+// directory is loaded again and watched from there; other errors are retried
+// with a growing delay.
+func (s *Store) Watch() {
+	watcher := s.client.Watcher(s.dir, EtcdWatcherOptions(s.waitIndex))
+	backoff := minWatchBackoff
+	for {
+		response, err := watcher.Next(context.TODO())
+		if err == nil {
+			backoff = minWatchBackoff
+			s.apply(response)
+			continue
+		}
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
+			s.logger().Warningf("Missed changes to %v, reloading it: %v", s.dir, err)
+			if err = s.Init(); err == nil {
+				watcher = s.client.Watcher(s.dir, EtcdWatcherOptions(s.waitIndex))
+				backoff = minWatchBackoff
+				continue
+			}
+		}
+		s.logger().Errorf("Error watching %v, retrying in %v: %v", s.dir, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// apply updates the store with a watch event, which may concern keys outside
+// the directory.
+func (s *Store) apply(response *client.Response) {
+	switch response.Action {
+	case "set", "update", "create", "compareAndSwap":
+		if s.isChild(response.Node) {
+			s.set(Tail(response.Node.Key), response.Node.Value)
+		}
+	case "delete", "expire", "compareAndDelete":
+		if s.isChild(response.PrevNode) {
+			s.delete(Tail(response.PrevNode.Key))
+		}
+	}
+}
+
+// contains reports whether key is inside the directory.
+func (s *Store) contains(key string) bool {
+	return strings.HasPrefix(key, s.dir+"/")
+}
+
+func (s *Store) logger() Logger {
+	return orDefault(s.log)
+}
+
+// isChild reports whether node is a value directly below the directory.
+func (s *Store) isChild(node *client.Node) bool {
+	if node == nil || node.Dir {
+		return false
+	}
+	return strings.TrimSuffix(node.Key, "/"+Tail(node.Key)) == s.dir
+}
+
+// Get returns the value stored under name.
+func (s *Store) Get(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[name]
+	return value, ok
+}
+
+func (s *Store) set(name, value string) {
+	s.mu.Lock()
+	s.values[name] = value
+	callbacks := s.onChange
+	s.mu.Unlock()
+	for _, f := range callbacks {
+		f(name, value, false)
+	}
+}
+
+func (s *Store) delete(name string) {
+	s.mu.Lock()
+	value := s.values[name]
+	delete(s.values, name)
+	callbacks := s.onChange
+	s.mu.Unlock()
+	for _, f := range callbacks {
+		f(name, value, true)
+	}
+}
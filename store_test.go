@@ -0,0 +1,242 @@
+package moria_test
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeys is an in-memory etcd keys API that delivers changes to watchers.
+type fakeKeys struct {
+	mu       sync.Mutex
+	index    uint64
+	values   map[string]string
+	history  []*etcd.Response
+	watchers []*fakeWatcher
+}
+
+func newFakeKeys() *fakeKeys {
+	return &fakeKeys{values: make(map[string]string)}
+}
+
+type fakeWatcher struct {
+	prefix string
+	events chan *etcd.Response
+	errs   chan error
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	select {
+	case response := <-w.events:
+		return response, nil
+	case err := <-w.errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (k *fakeKeys) node(key string) *etcd.Node {
+	if value, ok := k.values[key]; ok {
+		return &etcd.Node{Key: key, Value: value}
+	}
+	children := make(map[string]bool)
+	for existing := range k.values {
+		if strings.HasPrefix(existing, key+"/") {
+			children[key+"/"+strings.Split(strings.TrimPrefix(existing, key+"/"), "/")[0]] = true
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	dir := &etcd.Node{Key: key, Dir: true}
+	names := make([]string, 0, len(children))
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	for _, child := range names {
+		dir.Nodes = append(dir.Nodes, k.node(child))
+	}
+	return dir
+}
+
+func (k *fakeKeys) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	node := k.node("/" + strings.Trim(key, "/"))
+	if node == nil {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Index: k.index}
+	}
+	return &etcd.Response{Action: "get", Node: node, Index: k.index}, nil
+}
+
+func (k *fakeKeys) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.index++
+	response := &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value, ModifiedIndex: k.index}, Index: k.index}
+	if prev, ok := k.values[key]; ok {
+		response.PrevNode = &etcd.Node{Key: key, Value: prev}
+	}
+	k.values[key] = value
+	k.notify(response)
+	return response, nil
+}
+
+func (k *fakeKeys) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	prev, ok := k.values[key]
+	if !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Index: k.index}
+	}
+	k.index++
+	delete(k.values, key)
+	response := &etcd.Response{Action: "delete", Node: &etcd.Node{Key: key, ModifiedIndex: k.index}, PrevNode: &etcd.Node{Key: key, Value: prev}, Index: k.index}
+	k.notify(response)
+	return response, nil
+}
+
+func (k *fakeKeys) notify(response *etcd.Response) {
+	k.history = append(k.history, response)
+	for _, w := range k.watchers {
+		if strings.HasPrefix(response.Node.Key, w.prefix) {
+			w.events <- response
+		}
+	}
+}
+
+func (k *fakeKeys) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return k.Set(ctx, key, value, nil)
+}
+
+func (k *fakeKeys) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	return k.Set(ctx, dir+"/"+time.Now().Format("20060102150405.000000000"), value, nil)
+}
+
+func (k *fakeKeys) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return k.Set(ctx, key, value, nil)
+}
+
+func (k *fakeKeys) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w := &fakeWatcher{prefix: "/" + strings.Trim(key, "/"), events: make(chan *etcd.Response, 100), errs: make(chan error, 1)}
+	// Like etcd, replay everything that happened since AfterIndex.
+	for _, response := range k.history {
+		if response.Index >= opts.AfterIndex && strings.HasPrefix(response.Node.Key, w.prefix) {
+			w.events <- response
+		}
+	}
+	k.watchers = append(k.watchers, w)
+	return w
+}
+
+// compact changes keys without telling watchers, then forgets the history
+// and fails the current watches as etcd does once it has compacted away the
+// events they are waiting for.
+func (k *fakeKeys) compact(change func(values map[string]string)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	change(k.values)
+	k.index += 1000
+	k.history = nil
+	for _, w := range k.watchers {
+		w.errs <- etcd.Error{Code: etcd.ErrorCodeEventIndexCleared, Message: "The event in requested index is outdated and cleared", Index: k.index}
+	}
+	k.watchers = nil
+}
+
+// watched returns the directories being watched.
+func (k *fakeKeys) watched() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var prefixes []string
+	for _, w := range k.watchers {
+		prefixes = append(prefixes, w.prefix)
+	}
+	return prefixes
+}
+
+// eventually polls cond until it holds or a deadline passes.
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met before deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewayKey(t *testing.T) {
+	os.Setenv("VINE_ENV", "test")
+	if key := moria.GatewayKey("certificates"); key != "/gateway/certificates/test" {
+		t.Errorf("Expected /gateway/certificates/test got %v", key)
+	}
+}
+
+func TestStore(t *testing.T) {
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/gateway/things/test/one", "1", nil)
+	keys.Set(context.TODO(), "/gateway/things/test/nested/two", "2", nil)
+	store := moria.NewStore("/gateway/things/test", keys)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := store.Get("one"); !ok || value != "1" {
+		t.Errorf("Expected one to be 1 got %q", value)
+	}
+	if _, ok := store.Get("nested"); ok {
+		t.Error("Expected directories to be skipped")
+	}
+	go store.Watch()
+
+	keys.Set(context.TODO(), "/gateway/things/test/three", "3", nil)
+	eventually(t, func() bool { value, _ := store.Get("three"); return value == "3" })
+	keys.Delete(context.TODO(), "/gateway/things/test/one", nil)
+	eventually(t, func() bool { _, ok := store.Get("one"); return !ok })
+	keys.Set(context.TODO(), "/gateway/things/test/nested/four", "4", nil)
+	keys.Set(context.TODO(), "/gateway/things/test/five", "5", nil)
+	eventually(t, func() bool { _, ok := store.Get("five"); return ok })
+	if _, ok := store.Get("four"); ok {
+		t.Error("Expected nested keys to be ignored")
+	}
+}
+
+func TestStoreRecoversFromClearedIndex(t *testing.T) {
+	keys := newFakeKeys()
+	keys.Set(context.TODO(), "/gateway/things/test/one", "1", nil)
+	store := moria.NewStore("/gateway/things/test", keys)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	go store.Watch()
+	eventually(t, func() bool { return len(keys.watched()) == 1 })
+
+	keys.compact(func(values map[string]string) {
+		delete(values, "/gateway/things/test/one")
+		values["/gateway/things/test/two"] = "2"
+	})
+	eventually(t, func() bool { value, _ := store.Get("two"); return value == "2" })
+	if _, ok := store.Get("one"); ok {
+		t.Error("Expected a key deleted while the watch was behind to be removed")
+	}
+	keys.Set(context.TODO(), "/gateway/things/test/three", "3", nil)
+	eventually(t, func() bool { value, _ := store.Get("three"); return value == "3" })
+}
+
+func TestStoreMissingDirectory(t *testing.T) {
+	store := moria.NewStore("/gateway/missing/test", newFakeKeys())
+	if err := store.Init(); err != nil {
+		t.Errorf("Expected a missing directory to load as empty got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package moria
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultFlushInterval is how often buffered response data is pushed to the
+// client while a response body is being streamed.
+const defaultFlushInterval = 100 * time.Millisecond
+
+// copyBufferSize is the size of the pooled buffers used to stream bodies.
+const copyBufferSize = 32 * 1024
+
+// BufferPool is an interface for getting and returning temporary byte slices
+// used when copying request and response bodies.
+type BufferPool interface {
+	Get() []byte
+	Put([]byte)
+}
+
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool returns a BufferPool that hands out slices of the given size
+// and recycles them through a sync.Pool.
+func NewBufferPool(size int) BufferPool {
+	return &syncBufferPool{pool: sync.Pool{New: func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}}}
+}
+
+func (p *syncBufferPool) Get() []byte {
+	return *(p.pool.Get().(*[]byte))
+}
+
+func (p *syncBufferPool) Put(b []byte) {
+	p.pool.Put(&b)
+}
+
+// DefaultBufferPool is shared by every Mux that is not given its own pool.
+var DefaultBufferPool = NewBufferPool(copyBufferSize)
+
+// StreamingContentTypes lists response media types that are flushed to the
+// client chunk by chunk instead of on the periodic flush interval.
+var StreamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+}
+
+// FlushInterval reads the FLUSH_INTERVAL environment variable, a duration such
+// as "250ms".  A negative value flushes after every write and zero disables
+// periodic flushing.
+func FlushInterval() time.Duration {
+	v := os.Getenv("FLUSH_INTERVAL")
+	if v == "" {
+		return defaultFlushInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultFlushInterval
+	}
+	return d
+}
+
+// flushIntervalFor picks how a response is flushed.  Routes flagged as
+// streaming, gRPC responses and responses with a streaming content type are
+// flushed after every write; everything else uses the mux's periodic interval.
+func (mux *Mux) flushIntervalFor(handler *PatternHandler, response *http.Response) time.Duration {
+	if handler != nil && handler.Route != nil && handler.Route.Stream {
+		return -1
+	}
+	if isGRPC(response.Header) {
+		// Streaming RPCs deliver each message as soon as it is written.
+		return -1
+	}
+	if mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type")); err == nil {
+		for _, streaming := range StreamingContentTypes {
+			if mediaType == streaming {
+				return -1
+			}
+		}
+	}
+	return mux.flushInterval
+}
+
+// copyResponse streams src to dst through a pooled buffer, flushing dst
+// according to flushInterval.
+func (mux *Mux) copyResponse(dst http.ResponseWriter, src io.Reader, flushInterval time.Duration) (int64, error) {
+	var w io.Writer = dst
+	if flushInterval != 0 {
+		if flusher, ok := dst.(http.Flusher); ok {
+			mlw := &maxLatencyWriter{dst: dst, flusher: flusher, latency: flushInterval}
+			defer mlw.stop()
+			// Send the headers right away so the client sees the response
+			// start even if the first chunk of the body is slow to arrive.
+			mlw.flushPending = true
+			mlw.flush()
+			w = mlw
+		}
+	}
+	buf := mux.bufferPool.Get()
+	defer mux.bufferPool.Put(buf)
+	return copyBuffer(w, src, buf)
+}
+
+// copyBuffer is io.CopyBuffer without the WriterTo/ReaderFrom shortcuts, which
+// would bypass both the pooled buffer and the flushing writer.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	var written int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				rerr = nil
+			}
+			return written, rerr
+		}
+	}
+}
+
+// maxLatencyWriter flushes writes to the client either immediately, when
+// latency is negative, or at most latency after they happen.
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex // protects the fields below and writes to dst
+	t            *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.dst.Write(p)
+	if m.latency < 0 {
+		m.flusher.Flush()
+		return n, err
+	}
+	if m.flushPending {
+		return n, err
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return n, err
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flush()
+}
+
+// flush must be called with mu held.
+func (m *maxLatencyWriter) flush() {
+	if !m.flushPending {
+		return
+	}
+	m.flusher.Flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
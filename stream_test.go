@@ -0,0 +1,84 @@
+package moria_test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// readFirstLine returns the first line of body or fails after a timeout.
+func readFirstLine(t *testing.T, res *http.Response) string {
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("Chunk was not flushed to the client")
+	}
+	return ""
+}
+
+func TestMuxFlushesEventStream(t *testing.T) {
+	// Disable periodic flushing so only the streaming detection can deliver
+	// the first event before the backend finishes.
+	os.Setenv("FLUSH_INTERVAL", "0")
+	defer os.Unsetenv("FLUSH_INTERVAL")
+	cancelled := make(chan struct{})
+	_, backend, gateway := newGateway(t, "GET", "/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	res, err := http.Get(gateway.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := readFirstLine(t, res); line != "data: one\n" {
+		t.Errorf("Expected %q got %q", "data: one\n", line)
+	}
+
+	// Hanging up on the gateway must cancel the upstream request.
+	res.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Upstream request was not cancelled when the client went away")
+	}
+}
+
+func TestMuxFlushesStreamRoute(t *testing.T) {
+	os.Setenv("FLUSH_INTERVAL", "0")
+	defer os.Unsetenv("FLUSH_INTERVAL")
+	routes := []moria.EtcdRoute{{Method: "GET", Path: "/feed", Stream: true}}
+	_, backend, gateway := newGatewayRoutes(t, routes, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, "chunk\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	defer gateway.Close()
+
+	res, err := http.Get(gateway.URL + "/api/feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if line := readFirstLine(t, res); line != "chunk\n" {
+		t.Errorf("Expected %q got %q", "chunk\n", line)
+	}
+}
@@ -0,0 +1,191 @@
+package moria
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCertReloadInterval is how often certificate files are checked for
+// changes.
+const defaultCertReloadInterval = 30 * time.Second
+
+// KeyPair holds the gateway's TLS certificate.  A key pair loaded from files
+// can be reloaded when the files change; handshakes already in progress and
+// established connections keep the certificate they started with.
+type KeyPair struct {
+	certPath, keyPath string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	log     Logger
+}
+
+// NewKeyPair loads a certificate and private key from PEM files.
+func NewKeyPair(certPath, keyPath string) (*KeyPair, error) {
+	kp := &KeyPair{certPath: certPath, keyPath: keyPath}
+	if err := kp.load(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// NewKeyPairPEM builds a key pair from PEM encoded certificate and key data.
+// Key pairs created this way are never reloaded.
+func NewKeyPairPEM(certPEM, keyPEM []byte) (*KeyPair, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{cert: &cert}, nil
+}
+
+func (kp *KeyPair) load() error {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certPath, kp.keyPath)
+	if err != nil {
+		return err
+	}
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	return nil
+}
+
+// lastModified returns the most recent modification time of the two files.
+func (kp *KeyPair) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(kp.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(kp.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+// Reload re-reads the certificate files if either has changed since they
+// were last loaded.  The current certificate is kept if the new files cannot
+// be parsed, for example while only one of them has been replaced.
+func (kp *KeyPair) Reload() error {
+	if kp.certPath == "" {
+		return nil
+	}
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return err
+	}
+	kp.mu.RLock()
+	changed := !modTime.Equal(kp.modTime)
+	kp.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err := kp.load(); err != nil {
+		return err
+	}
+	orDefault(kp.log).Infof("Reloaded TLS certificate from %v", kp.certPath)
+	return nil
+}
+
+// Watch reloads the key pair every interval until stop is closed.
+func (kp *KeyPair) Watch(interval time.Duration, stop <-chan struct{}) {
+	if kp.certPath == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := kp.Reload(); err != nil {
+				orDefault(kp.log).Errorf("Unable to reload TLS certificate: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Certificate returns the currently loaded certificate.
+func (kp *KeyPair) Certificate() *tls.Certificate {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+// ServerKeyPair loads the gateway certificate from TLS_CERT_PATH and
+// TLS_KEY_PATH, or from TLS_CERT_STRING and TLS_KEY_STRING which hold PEM data
+// with escaped newlines the same way ETCD_CA_STRING does.  It returns nil if
+// neither is configured.
+func ServerKeyPair() (*KeyPair, error) {
+	certPath, keyPath := os.Getenv("TLS_CERT_PATH"), os.Getenv("TLS_KEY_PATH")
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, errors.New("TLS_CERT_PATH and TLS_KEY_PATH must be set together")
+		}
+		return NewKeyPair(certPath, keyPath)
+	}
+	certPEM, keyPEM := pemFromEnv("TLS_CERT_STRING"), pemFromEnv("TLS_KEY_STRING")
+	if len(certPEM) != 0 || len(keyPEM) != 0 {
+		if len(certPEM) == 0 || len(keyPEM) == 0 {
+			return nil, errors.New("TLS_CERT_STRING and TLS_KEY_STRING must be set together")
+		}
+		return NewKeyPairPEM(certPEM, keyPEM)
+	}
+	return nil, nil
+}
+
+// CertReloadInterval reads TLS_RELOAD_INTERVAL, the duration between checks
+// of the certificate files.
+func CertReloadInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("TLS_RELOAD_INTERVAL"))
+	if err != nil || d <= 0 {
+		return defaultCertReloadInterval
+	}
+	return d
+}
+
+func pemFromEnv(name string) []byte {
+	return []byte(strings.Replace(os.Getenv(name), "\\n", "\n", -1))
+}
+
+// ServerTLSConfig returns the TLS settings used by the gateway listener with
+// certificates supplied by getCertificate.
+func ServerTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+		},
+		// Only forward secret AEAD suites; TLS 1.3 suites are not
+		// configurable and are all acceptable.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+}
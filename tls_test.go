@@ -0,0 +1,164 @@
+package moria_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// generateCert writes a fresh self-signed certificate for commonName to the
+// given paths.
+func generateCert(t *testing.T, commonName, certPath, keyPath string) {
+	certPEM, keyPEM := generateCertPEM(t, commonName)
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generateCertPEM(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestNewKeyPair(t *testing.T) {
+	kp, err := moria.NewKeyPair("superfake.com.cert", "superfake.com.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, kp.Certificate()); name != "superfake.com" {
+		t.Errorf("Expected superfake.com got %v", name)
+	}
+}
+
+func TestServerKeyPairFromEnv(t *testing.T) {
+	certPEM, _ := ioutil.ReadFile("superfake.com.cert")
+	keyPEM, _ := ioutil.ReadFile("superfake.com.key")
+	os.Setenv("TLS_CERT_STRING", strings.Replace(string(certPEM), "\n", "\\n", -1))
+	os.Setenv("TLS_KEY_STRING", strings.Replace(string(keyPEM), "\n", "\\n", -1))
+	defer os.Unsetenv("TLS_CERT_STRING")
+	defer os.Unsetenv("TLS_KEY_STRING")
+	kp, err := moria.ServerKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, kp.Certificate()); name != "superfake.com" {
+		t.Errorf("Expected superfake.com got %v", name)
+	}
+}
+
+func TestServerKeyPairUnconfigured(t *testing.T) {
+	kp, err := moria.ServerKeyPair()
+	if kp != nil || err != nil {
+		t.Errorf("Expected no key pair and no error got %v, %v", kp, err)
+	}
+}
+
+func TestServerKeyPairMissingKey(t *testing.T) {
+	os.Setenv("TLS_CERT_PATH", "superfake.com.cert")
+	defer os.Unsetenv("TLS_CERT_PATH")
+	if _, err := moria.ServerKeyPair(); err == nil {
+		t.Error("Expected an error when TLS_KEY_PATH is missing")
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moria-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	generateCert(t, "before.example.com", certPath, keyPath)
+	kp, err := moria.NewKeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generateCert(t, "after.example.com", certPath, keyPath)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	if err := kp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, kp.Certificate()); name != "after.example.com" {
+		t.Errorf("Expected after.example.com got %v", name)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	kp, err := moria.NewKeyPair("superfake.com.cert", "superfake.com.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", moria.ServerTLSConfig(kp.GetCertificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.Version != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 got %x", state.Version)
+	}
+	if name := state.PeerCertificates[0].Subject.CommonName; name != "superfake.com" {
+		t.Errorf("Expected superfake.com got %v", name)
+	}
+
+	_, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	if err == nil {
+		t.Error("Expected TLS 1.1 handshake to be refused")
+	}
+}
@@ -0,0 +1,362 @@
+package moria
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// W3C trace context headers.
+const (
+	Traceparent = "Traceparent"
+	Tracestate  = "Tracestate"
+)
+
+const (
+	sampledFlag       = 0x01
+	defaultTraceQueue = 2048
+	defaultTraceBatch = 512
+	defaultTraceDelay = 5 * time.Second
+	spanKindClient    = 3
+	spanStatusError   = 2
+)
+
+// traceContext identifies the span a request belongs to.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+// parseTraceparent parses a traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".  Versions after
+// 00 may append fields, which are ignored.
+func parseTraceparent(value string) (traceContext, bool) {
+	var tc traceContext
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return tc, false
+	}
+	version, err := hex.DecodeString(value[0:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return tc, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return tc, false
+	}
+	if !isLowerHex(value[3:35]) || !isLowerHex(value[36:52]) || !isLowerHex(value[53:55]) {
+		return tc, false
+	}
+	hex.Decode(tc.traceID[:], []byte(value[3:35]))
+	hex.Decode(tc.spanID[:], []byte(value[36:52]))
+	flags, _ := hex.DecodeString(value[53:55])
+	tc.flags = flags[0]
+	if tc.traceID == ([16]byte{}) || tc.spanID == ([8]byte{}) {
+		return tc, false
+	}
+	return tc, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (tc traceContext) sampled() bool {
+	return tc.flags&sampledFlag != 0
+}
+
+func (tc traceContext) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.traceID, tc.spanID, tc.flags)
+}
+
+// span is the gateway's part of a trace: one round trip to a backend.
+type span struct {
+	traceContext
+	parentID   [8]byte
+	name       string
+	start, end time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// startSpan starts the span for forwarding request, continuing the trace of
+// its traceparent header or starting a new one.  New traces are sampled when
+// spans are exported.
+func (mux *Mux) startSpan(request *http.Request, handler *PatternHandler, address string) *span {
+	s := &span{name: handler.name(), start: time.Now()}
+	if parent, ok := parseTraceparent(request.Header.Get(Traceparent)); ok {
+		s.traceContext, s.parentID = parent, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+		if mux.tracer != nil {
+			s.flags = sampledFlag
+		}
+	}
+	rand.Read(s.spanID[:])
+	s.attributes = map[string]interface{}{
+		"http.request.method": request.Method,
+		"http.route":          handler.name(),
+		"url.path":            request.URL.Path,
+		"server.address":      address,
+		"moria.service":       handler.Service,
+	}
+	return s
+}
+
+// propagate passes the span's context on to the backend.  The client's
+// tracestate is passed on untouched when its trace is continued, and dropped
+// along with an invalid or missing traceparent, as W3C trace context asks.
+func (s *span) propagate(innerRequest *http.Request) {
+	innerRequest.Header.Set(Traceparent, s.traceparent())
+	if s.parentID == ([8]byte{}) {
+		innerRequest.Header.Del(Tracestate)
+	}
+}
+
+// finishSpan ends the span with the backend's response or the error
+// forwarding to it, and queues it for export when the trace is sampled.  As
+// for any client span, 4xx and 5xx responses mark it as failed.
+func (mux *Mux) finishSpan(s *span, response *http.Response, err error) {
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	} else {
+		s.attributes["http.response.status_code"] = response.StatusCode
+		if response.StatusCode >= 400 {
+			s.err = response.Status
+		}
+	}
+	if mux.tracer != nil && s.sampled() {
+		mux.tracer.export(s)
+	}
+}
+
+// Tracer exports the gateway's spans to an OpenTelemetry collector over
+// OTLP/HTTP, using the JSON encoding.  Spans are sent in batches; they are
+// dropped when the collector cannot keep up.
+type Tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	delay    time.Duration
+	queue    chan *span
+	flushes  chan chan struct{}
+	dropped  int64
+	log      Logger
+}
+
+// NewTracer returns a tracer posting spans to endpoint, e.g.
+// "http://collector:4318/v1/traces", at least every delay.  service is the
+// service.name the spans are reported under.
+func NewTracer(endpoint, service string, delay time.Duration) *Tracer {
+	return newTracer(endpoint, service, delay, defaultLogger)
+}
+
+func newTracer(endpoint, service string, delay time.Duration, log Logger) *Tracer {
+	t := &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		delay:    delay,
+		queue:    make(chan *span, defaultTraceQueue),
+		flushes:  make(chan chan struct{}),
+		log:      log,
+	}
+	go t.run()
+	return t
+}
+
+// TracerFromEnv configures a tracer from the standard OpenTelemetry
+// variables: OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT
+// with "/v1/traces" appended, OTEL_SERVICE_NAME (moria by default) and
+// OTEL_BSP_SCHEDULE_DELAY in milliseconds.  It returns nil if no endpoint is
+// set, in which case trace context is still propagated.
+func TracerFromEnv() *Tracer {
+	return tracerFromEnv(defaultLogger)
+}
+
+func tracerFromEnv(log Logger) *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "moria"
+	}
+	delay := defaultTraceDelay
+	if ms, err := strconv.Atoi(os.Getenv("OTEL_BSP_SCHEDULE_DELAY")); err == nil && ms > 0 {
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	return newTracer(endpoint, service, delay, log)
+}
+
+// export queues a finished span.
+func (t *Tracer) export(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// Flush sends the spans queued so far and waits for the collector to answer.
+func (t *Tracer) Flush() {
+	done := make(chan struct{})
+	t.flushes <- done
+	<-done
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.delay)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < defaultTraceBatch {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-t.flushes:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			t.send(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+// send posts a batch of spans to the collector.
+func (t *Tracer) send(batch []*span) {
+	if dropped := atomic.SwapInt64(&t.dropped, 0); dropped > 0 {
+		t.log.Warningf("Dropped %d spans, the export queue was full", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.payload(batch))
+	if err != nil {
+		t.log.Errorf("Unable to encode spans: %v", err)
+		return
+	}
+	response, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.log.Errorf("Unable to export %d spans: %v", len(batch), err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		t.log.Errorf("Unable to export %d spans: collector answered %v", len(batch), response.Status)
+	}
+}
+
+// OTLP JSON messages, as described by opentelemetry-proto.  IDs are hex
+// encoded and 64 bit integers are strings.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (t *Tracer) payload(batch []*span) otlpTraces {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              spanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": t.service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "moria"}, Spans: spans}},
+	}}}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		switch v := attributes[k].(type) {
+		case int:
+			out = append(out, otlpAttribute{k, map[string]string{"intValue": strconv.Itoa(v)}})
+		default:
+			out = append(out, otlpAttribute{k, map[string]string{"stringValue": fmt.Sprint(v)}})
+		}
+	}
+	return out
+}
@@ -0,0 +1,166 @@
+package moria_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/combatgent/moria"
+)
+
+// collector stands in for an OpenTelemetry collector receiving OTLP/HTTP
+// JSON.
+type collector struct {
+	mu    sync.Mutex
+	spans []map[string]interface{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range payload.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *collector) received() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]map[string]interface{}{}, c.spans...)
+}
+
+// attribute returns the value of a span attribute as a string.
+func attribute(span map[string]interface{}, key string) string {
+	attributes, _ := span["attributes"].([]interface{})
+	for _, a := range attributes {
+		a := a.(map[string]interface{})
+		if a["key"] == key {
+			for _, v := range a["value"].(map[string]interface{}) {
+				return v.(string)
+			}
+		}
+	}
+	return ""
+}
+
+var traceparentFormat = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// tracedGateway routes GET /orders/:id to a backend recording the trace
+// headers it receives, and exports spans to a collector.
+func tracedGateway(t *testing.T) (*moria.Mux, *collector, chan http.Header, func()) {
+	spans := &collector{}
+	otlp := httptest.NewServer(spans)
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", otlp.URL)
+	os.Setenv("OTEL_BSP_SCHEDULE_DELAY", "10")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_BSP_SCHEDULE_DELAY")
+	received := make(chan http.Header, 10)
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/orders/:id"}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { received <- r.Header }))
+	return mux, spans, received, func() {
+		gateway.Close()
+		backend.Close()
+		otlp.Close()
+	}
+}
+
+func TestTraceContinuesIncomingTrace(t *testing.T) {
+	mux, spans, received, done := tracedGateway(t)
+	defer done()
+
+	request := httptest.NewRequest("GET", "http://gateway/api/orders/1", nil)
+	request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Set("Tracestate", "vendor=abc")
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	header := <-received
+	parts := traceparentFormat.FindStringSubmatch(header.Get("Traceparent"))
+	if parts == nil || parts[1] != "4bf92f3577b34da6a3ce929d0e0e4736" || parts[2] == "00f067aa0ba902b7" || parts[3] != "01" {
+		t.Fatalf("Expected the trace to continue from the gateway span got %q", header.Get("Traceparent"))
+	}
+	if header.Get("Tracestate") != "vendor=abc" {
+		t.Errorf("Expected tracestate to be passed on got %q", header.Get("Tracestate"))
+	}
+
+	eventually(t, func() bool { return len(spans.received()) == 1 })
+	span := spans.received()[0]
+	expected := map[string]string{
+		"traceId": parts[1], "spanId": parts[2], "parentSpanId": "00f067aa0ba902b7", "name": "GET /orders/:id",
+	}
+	for k, v := range expected {
+		if span[k] != v {
+			t.Errorf("Expected span %v: %v got %v", k, v, span[k])
+		}
+	}
+	if attribute(span, "http.route") != "GET /orders/:id" || attribute(span, "http.response.status_code") != "200" {
+		t.Errorf("Expected route and status attributes got %v", span["attributes"])
+	}
+	if attribute(span, "server.address") == "" || attribute(span, "moria.service") != "test-service" {
+		t.Errorf("Expected backend attributes got %v", span["attributes"])
+	}
+}
+
+func TestTraceStartsNewTrace(t *testing.T) {
+	mux, spans, received, done := tracedGateway(t)
+	defer done()
+
+	for _, traceparent := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "garbage"} {
+		request := httptest.NewRequest("GET", "http://gateway/api/orders/1", nil)
+		if traceparent != "" {
+			request.Header.Set("Traceparent", traceparent)
+		}
+		request.Header.Set("Tracestate", "vendor=abc")
+		mux.ServeHTTP(httptest.NewRecorder(), request)
+		header := <-received
+		parts := traceparentFormat.FindStringSubmatch(header.Get("Traceparent"))
+		if parts == nil || strings.Trim(parts[1], "0") == "" || parts[3] != "01" {
+			t.Errorf("Expected a new sampled trace for %q got %q", traceparent, header.Get("Traceparent"))
+		}
+		if got := header.Get("Tracestate"); got != "" {
+			t.Errorf("Expected tracestate to be dropped with %q got %q", traceparent, got)
+		}
+	}
+	eventually(t, func() bool { return len(spans.received()) == 3 })
+	for _, span := range spans.received() {
+		if _, ok := span["parentSpanId"]; ok {
+			t.Errorf("Expected new traces to start at the gateway got %v", span)
+		}
+	}
+}
+
+func TestTraceUnsampledNotExported(t *testing.T) {
+	mux, spans, received, done := tracedGateway(t)
+	defer done()
+
+	for _, flags := range []string{"00", "01"} {
+		request := httptest.NewRequest("GET", "http://gateway/api/orders/1", nil)
+		request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"+flags)
+		mux.ServeHTTP(httptest.NewRecorder(), request)
+		if got := (<-received).Get("Traceparent"); !strings.HasSuffix(got, "-"+flags) {
+			t.Errorf("Expected the sampled flag %v to be passed on got %q", flags, got)
+		}
+	}
+	eventually(t, func() bool { return len(spans.received()) > 0 })
+	if got := spans.received(); len(got) != 1 {
+		t.Errorf("Expected only the sampled span to be exported got %v", got)
+	}
+}
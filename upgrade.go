@@ -0,0 +1,172 @@
+package moria
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUpgradeIdleTimeout closes upgraded connections that have carried no
+// traffic in either direction for this long.
+const defaultUpgradeIdleTimeout = 10 * time.Minute
+
+// UpgradeIdleTimeout reads the UPGRADE_IDLE_TIMEOUT environment variable, a
+// duration such as "90s".  Zero disables the idle timeout.
+func UpgradeIdleTimeout() time.Duration {
+	v := os.Getenv("UPGRADE_IDLE_TIMEOUT")
+	if v == "" {
+		return defaultUpgradeIdleTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultUpgradeIdleTimeout
+	}
+	return d
+}
+
+// upgradeType returns the protocol a request or response asks to switch to,
+// or "" if the Connection header does not carry the upgrade token.
+func upgradeType(h http.Header) string {
+	for _, v := range h[Connection] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return strings.ToLower(h.Get(Upgrade))
+			}
+		}
+	}
+	return ""
+}
+
+// tunnel is a hijacked client connection piped to a backend connection.
+type tunnel struct {
+	address string
+	client  net.Conn
+	backend io.ReadWriteCloser
+	once    sync.Once
+}
+
+func (t *tunnel) close() {
+	t.once.Do(func() {
+		t.client.Close()
+		t.backend.Close()
+	})
+}
+
+// handleUpgradeResponse completes a protocol switch that the backend accepted
+// by hijacking the client connection and piping bytes in both directions
+// until either side closes, the tunnel goes idle or the backend address is
+// removed from the mux.
+func (mux *Mux) handleUpgradeResponse(log Logger, writer http.ResponseWriter, request *http.Request, response *http.Response, address string) {
+	reqUpType := upgradeType(request.Header)
+	resUpType := upgradeType(response.Header)
+	if reqUpType != resUpType {
+		response.Body.Close()
+		mux.ctx.errHandler.ServeHTTP(writer, request, fmt.Errorf("backend tried to switch protocol %q when %q was requested", resUpType, reqUpType))
+		return
+	}
+	backend, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		response.Body.Close()
+		mux.ctx.errHandler.ServeHTTP(writer, request, fmt.Errorf("internal error: 101 switching protocols response with non-writable body"))
+		return
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		backend.Close()
+		mux.ctx.errHandler.ServeHTTP(writer, request, fmt.Errorf("can't switch protocols using non-Hijacker ResponseWriter type %T", writer))
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		backend.Close()
+		mux.ctx.errHandler.ServeHTTP(writer, request, fmt.Errorf("Hijack failed on protocol switch: %v", err))
+		return
+	}
+
+	t := &tunnel{address: address, client: conn, backend: backend}
+	mux.openTunnel(t)
+	defer mux.closeTunnel(t)
+
+	// Relay the 101 response itself before any upgraded traffic.
+	response.Body = nil
+	if err := response.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		log.Errorf("Error writing switching protocols response: %v", err)
+		return
+	}
+	log.Infof("Switched %v %v to %v via %v", request.Method, mux.redactURL(request.URL), reqUpType, address)
+
+	var idle *time.Timer
+	touch := func() {}
+	if mux.upgradeIdleTimeout > 0 {
+		idle = time.AfterFunc(mux.upgradeIdleTimeout, t.close)
+		defer idle.Stop()
+		touch = func() { idle.Reset(mux.upgradeIdleTimeout) }
+	}
+
+	errc := make(chan error, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		buf := mux.bufferPool.Get()
+		defer mux.bufferPool.Put(buf)
+		_, err := copyBuffer(dst, &activityReader{r: src, touch: touch}, buf)
+		errc <- err
+	}
+	// Read from the hijacked bufio.Reader so that anything the server already
+	// buffered from the client is not lost.
+	go pipe(backend, brw)
+	go pipe(conn, backend)
+	<-errc
+	t.close()
+	<-errc
+}
+
+// activityReader calls touch every time data is read through it.
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+func (mux *Mux) openTunnel(t *tunnel) {
+	mux.tunnelsMu.Lock()
+	defer mux.tunnelsMu.Unlock()
+	tunnels, present := mux.tunnels[t.address]
+	if !present {
+		tunnels = make(map[*tunnel]struct{})
+		mux.tunnels[t.address] = tunnels
+	}
+	tunnels[t] = struct{}{}
+}
+
+func (mux *Mux) closeTunnel(t *tunnel) {
+	t.close()
+	mux.tunnelsMu.Lock()
+	defer mux.tunnelsMu.Unlock()
+	delete(mux.tunnels[t.address], t)
+	if len(mux.tunnels[t.address]) == 0 {
+		delete(mux.tunnels, t.address)
+	}
+}
+
+// closeTunnels shuts every upgraded connection to a backend address.
+func (mux *Mux) closeTunnels(address string) {
+	mux.tunnelsMu.Lock()
+	defer mux.tunnelsMu.Unlock()
+	for t := range mux.tunnels[address] {
+		t.close()
+	}
+}
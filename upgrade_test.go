@@ -0,0 +1,113 @@
+package moria_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/combatgent/moria"
+)
+
+// echoUpgrade switches to a toy "echo" protocol and echoes every byte back.
+var echoUpgrade = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+})
+
+// dialUpgrade performs the echo handshake through the gateway.
+func dialUpgrade(t *testing.T, gatewayURL string) (net.Conn, *bufio.Reader) {
+	u, _ := url.Parse(gatewayURL)
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /api/ws HTTP/1.1\r\nHost: " + u.Host + "\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected %d got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+	return conn, br
+}
+
+func TestMuxUpgrade(t *testing.T) {
+	_, backend, gateway := newGateway(t, "GET", "/ws", echoUpgrade)
+	defer backend.Close()
+	defer gateway.Close()
+
+	conn, br := dialUpgrade(t, gateway.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello\n"))
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("Expected echo of %q got %q", "hello\n", line)
+	}
+}
+
+func TestMuxUpgradeClosedOnRemove(t *testing.T) {
+	mux, backend, gateway := newGatewayRoutes(t, []moria.EtcdRoute{{Method: "GET", Path: "/ws"}, {Method: "GET", Path: "/other"}}, echoUpgrade)
+	defer backend.Close()
+	defer gateway.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	conn, br := dialUpgrade(t, gateway.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	mux.Remove("GET", "/other", address, "test-service-1")
+	conn.Write([]byte("still there\n"))
+	if line, err := br.ReadString('\n'); err != nil || line != "still there\n" {
+		t.Errorf("Expected the tunnel to survive while its address is routed got %q %v", line, err)
+	}
+	mux.Remove("GET", "/ws", address, "test-service-1")
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected tunnel to be closed with EOF got %v", err)
+	}
+}
+
+func TestMuxUpgradeIdleTimeout(t *testing.T) {
+	t.Setenv("UPGRADE_IDLE_TIMEOUT", "300ms")
+	_, backend, gateway := newGateway(t, "GET", "/ws", echoUpgrade)
+	defer backend.Close()
+	defer gateway.Close()
+
+	conn, br := dialUpgrade(t, gateway.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Traffic keeps the tunnel open past the timeout.
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		conn.Write([]byte("ping\n"))
+		if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+			t.Fatalf("Expected an active tunnel to stay open got %q %v", line, err)
+		}
+	}
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the idle tunnel to be closed with EOF got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the idle tunnel to be closed after about 300ms took %v", elapsed)
+	}
+}
@@ -0,0 +1,169 @@
+package moria
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+// UpstreamConfig describes how the gateway connects to a service's hosts.
+// It is the "upstream" section of a service's config, e.g.
+//
+//	{"upstream": {"scheme": "https", "ca": "-----BEGIN CERTIFICATE-----...", "server_name": "orders.internal"}}
+//
+// A host entry registered with a scheme, such as https://10.0.0.5:443, takes
+// precedence over Scheme.  Setting Protocol to "h2c" speaks HTTP/2 without
+// TLS to services that support it; HTTPS services negotiate HTTP/2 on their
+// own.  h2c cannot be combined with TLS settings or https host entries; such
+// upstreams are refused rather than letting traffic meant to be encrypted go
+// out in the clear.
+type UpstreamConfig struct {
+	Scheme     string `json:"scheme,omitempty"`      // "http" (the default) or "https".
+	Protocol   string `json:"protocol,omitempty"`    // "h2c" for cleartext HTTP/2.
+	CA         string `json:"ca,omitempty"`          // PEM bundle used to verify the service's certificate.
+	Cert       string `json:"cert,omitempty"`        // PEM client certificate presented to the service.
+	Key        string `json:"key,omitempty"`         // PEM private key for Cert.
+	ServerName string `json:"server_name,omitempty"` // Name verified in the service's certificate.
+}
+
+// errH2CWithTLS refuses upstreams that would send traffic meant to be
+// encrypted over cleartext HTTP/2.
+var errH2CWithTLS = errors.New("h2c is cleartext and cannot be combined with TLS settings")
+
+// upstream is how requests reach one backend address.
+type upstream struct {
+	scheme    string
+	transport http.RoundTripper
+}
+
+// serviceTransport is a transport built for a service's upstream config.
+type serviceTransport struct {
+	config    UpstreamConfig
+	transport http.RoundTripper
+}
+
+// splitAddress separates an optional scheme from a registered host address.
+func splitAddress(address string) (string, string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return strings.ToLower(address[:i]), strings.TrimSuffix(address[i+3:], "/")
+	}
+	return "", address
+}
+
+// setUpstream records how to reach address for the service it belongs to.
+// The caller must hold the write lock.
+func (mux *Mux) setUpstream(address string, serviceRecord *ServiceRecord) {
+	scheme, host := splitAddress(address)
+	var config *UpstreamConfig
+	if serviceRecord != nil && serviceRecord.Config != nil {
+		config = serviceRecord.Config.Upstream
+	}
+	if scheme == "" && config != nil {
+		scheme = strings.ToLower(config.Scheme)
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	transport := mux.roundTripper
+	if config != nil && (config.CA != "" || config.Cert != "" || config.ServerName != "" || config.Protocol != "") {
+		transport = mux.serviceTransport(serviceRecord.Name, config)
+	}
+	// The host entry's scheme wins over the config's, so it has to be
+	// checked against h2c here as well.
+	if config != nil && strings.ToLower(config.Protocol) == "h2c" && scheme == "https" {
+		mux.ctx.log.Errorf("Invalid upstream for %v at %v, refusing requests: %v", serviceRecord.Name, address, errH2CWithTLS)
+		transport = refusingTransport{errH2CWithTLS}
+	}
+	mux.upstreams[host] = &upstream{scheme: scheme, transport: transport}
+}
+
+// serviceTransport returns the transport for a service, building a new one
+// when the service's upstream config has changed.  The caller must hold the
+// write lock.
+func (mux *Mux) serviceTransport(service string, config *UpstreamConfig) http.RoundTripper {
+	if existing, ok := mux.transports[service]; ok && existing.config == *config {
+		return existing.transport
+	}
+	transport, err := newUpstreamTransport(config)
+	if err != nil {
+		mux.ctx.log.Errorf("Invalid upstream config for %v, refusing requests: %v", service, err)
+		transport = refusingTransport{err}
+	}
+	if existing, ok := mux.transports[service]; ok {
+		if t, ok := existing.transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	mux.transports[service] = &serviceTransport{config: *config, transport: transport}
+	return transport
+}
+
+// upstreamFor returns how to reach a backend address.
+func (mux *Mux) upstreamFor(address string) *upstream {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	if up, ok := mux.upstreams[address]; ok {
+		return up
+	}
+	return &upstream{scheme: "http", transport: mux.roundTripper}
+}
+
+// newUpstreamTransport builds a transport that verifies services against the
+// configured CA bundle and presents the configured client certificate.
+func newUpstreamTransport(config *UpstreamConfig) (http.RoundTripper, error) {
+	if strings.ToLower(config.Protocol) == "h2c" {
+		if strings.ToLower(config.Scheme) == "https" || config.CA != "" || config.Cert != "" || config.Key != "" || config.ServerName != "" {
+			return nil, errH2CWithTLS
+		}
+		return newH2CTransport(), nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+	if config.CA != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(config.CA)) {
+			return nil, errors.New("no certificates found in upstream CA bundle")
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		cert, err := tls.X509KeyPair([]byte(config.Cert), []byte(config.Key))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	return transport, nil
+}
+
+// refusingTransport fails every request to a service whose upstream config
+// is invalid.
+type refusingTransport struct {
+	err error
+}
+
+func (t refusingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// newH2CTransport returns a transport speaking HTTP/2 over plain TCP, so many
+// requests to a service share a few multiplexed connections.
+func newH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
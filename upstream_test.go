@@ -0,0 +1,159 @@
+package moria_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/combatgent/moria"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// tlsBackend starts an HTTPS backend and returns it with its CA in PEM form.
+func tlsBackend(handler http.Handler) (*httptest.Server, string) {
+	backend := httptest.NewTLSServer(handler)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	return backend, string(ca)
+}
+
+func gatewayFor(t *testing.T, address string, config *moria.ServiceConfig) *httptest.Server {
+	record := &moria.ServiceRecord{ID: "secure-1", Name: "secure", Address: address, Config: config}
+	record.GenerateRecord([]moria.EtcdRoute{{Method: "GET", Path: "/secure"}})
+	mux := moria.NewMux()
+	register(mux, record)
+	return httptest.NewServer(mux)
+}
+
+func get(t *testing.T, url string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return do(t, req)
+}
+
+// do sends req and returns the response status and body.
+func do(t *testing.T, req *http.Request) (int, string) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+var schemeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		w.Write([]byte("https"))
+		return
+	}
+	w.Write([]byte("http"))
+})
+
+func TestUpstreamHTTPSFromConfig(t *testing.T) {
+	backend, ca := tlsBackend(schemeHandler)
+	defer backend.Close()
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{Scheme: "https", CA: ca, ServerName: "example.com"}}
+	gateway := gatewayFor(t, strings.TrimPrefix(backend.URL, "https://"), config)
+	defer gateway.Close()
+
+	if status, body := get(t, gateway.URL+"/api/secure"); status != http.StatusOK || body != "https" {
+		t.Errorf("Expected 200 https got %d %v", status, body)
+	}
+}
+
+func TestUpstreamHTTPSFromHostEntry(t *testing.T) {
+	backend, ca := tlsBackend(schemeHandler)
+	defer backend.Close()
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{CA: ca, ServerName: "example.com"}}
+	gateway := gatewayFor(t, backend.URL, config)
+	defer gateway.Close()
+
+	if status, body := get(t, gateway.URL+"/api/secure"); status != http.StatusOK || body != "https" {
+		t.Errorf("Expected 200 https got %d %v", status, body)
+	}
+}
+
+func TestUpstreamHTTPSUntrusted(t *testing.T) {
+	backend, _ := tlsBackend(schemeHandler)
+	defer backend.Close()
+	gateway := gatewayFor(t, backend.URL, nil)
+	defer gateway.Close()
+
+	if status, _ := get(t, gateway.URL+"/api/secure"); status != http.StatusBadGateway && status != http.StatusInternalServerError {
+		t.Errorf("Expected an error for an untrusted backend got %d", status)
+	}
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	certPEM, keyPEM := generateCertPEM(t, "moria.internal")
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	backend.StartTLS()
+	defer backend.Close()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}))
+
+	// Without a client certificate the backend refuses the handshake.
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{CA: ca, ServerName: "example.com"}}
+	gateway := gatewayFor(t, backend.URL, config)
+	if status, _ := get(t, gateway.URL+"/api/secure"); status == http.StatusOK {
+		t.Error("Expected the backend to refuse a gateway without a client certificate")
+	}
+	gateway.Close()
+
+	config.Upstream.Cert, config.Upstream.Key = string(certPEM), string(keyPEM)
+	gateway = gatewayFor(t, backend.URL, config)
+	defer gateway.Close()
+	if status, body := get(t, gateway.URL+"/api/secure"); status != http.StatusOK || body != "moria.internal" {
+		t.Errorf("Expected 200 moria.internal got %d %v", status, body)
+	}
+}
+
+func TestUpstreamH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer backend.Close()
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{Protocol: "h2c"}}
+	gateway := gatewayFor(t, strings.TrimPrefix(backend.URL, "http://"), config)
+	defer gateway.Close()
+
+	if status, body := get(t, gateway.URL+"/api/secure"); status != http.StatusOK || body != "HTTP/2.0" {
+		t.Errorf("Expected 200 HTTP/2.0 got %d %v", status, body)
+	}
+}
+
+func TestUpstreamH2CWithTLSRefused(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(schemeHandler, &http2.Server{}))
+	defer backend.Close()
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{Protocol: "h2c", ServerName: "orders.internal"}}
+	gateway := gatewayFor(t, strings.TrimPrefix(backend.URL, "http://"), config)
+	defer gateway.Close()
+
+	if status, body := get(t, gateway.URL+"/api/secure"); status == http.StatusOK {
+		t.Errorf("Expected h2c combined with TLS settings to be refused got %d %v", status, body)
+	}
+}
+
+func TestUpstreamH2CWithHTTPSHostRefused(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(schemeHandler, &http2.Server{}))
+	defer backend.Close()
+	config := &moria.ServiceConfig{Upstream: &moria.UpstreamConfig{Protocol: "h2c"}}
+	gateway := gatewayFor(t, "https://"+strings.TrimPrefix(backend.URL, "http://"), config)
+	defer gateway.Close()
+
+	if status, body := get(t, gateway.URL+"/api/secure"); status == http.StatusOK {
+		t.Errorf("Expected h2c to an https host entry to be refused got %d %v", status, body)
+	}
+}